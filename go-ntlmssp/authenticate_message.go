@@ -2,203 +2,464 @@ package ntlmssp
 
 import (
 	"bytes"
-	"crypto/rand"
 	"encoding/binary"
 	"encoding/hex"
-	"errors"
-	"log"
+	"fmt"
+	"io"
+	"log/slog"
 	"strings"
 	"time"
 )
 
-type authenicateMessage struct {
+// AuthenticateMessage is an AUTHENTICATE (Type 3) message, sent by the client in
+// response to a CHALLENGE message, see https://msdn.microsoft.com/en-us/library/cc236643.aspx
+type AuthenticateMessage struct {
 	LmChallengeResponse []byte
 	NtChallengeResponse []byte
 
-	TargetName string
-	UserName   string
+	DomainName  string
+	UserName    string
+	Workstation string
 
-	// only set if negotiateFlag_NTLMSSP_NEGOTIATE_KEY_EXCH
+	// only set if NTLMSSP_NEGOTIATE_KEY_EXCH is negotiated
 	EncryptedRandomSessionKey []byte
 
-	NegotiateFlags negotiateFlags
+	NegotiateFlags NegotiateFlags
 
+	// Version is only sent if set, NTLMSSP_NEGOTIATE_VERSION is cleared otherwise
+	Version *Version
+
+	// only set if the target info carries MsvAvFlags with the MIC present bit
 	MIC []byte
+
+	// CodePage encodes the names when NTLM_NEGOTIATE_OEM is negotiated
+	// instead of NTLMSSP_NEGOTIATE_UNICODE
+	CodePage *CodePage
 }
 
+// micOffset is the position of the MIC within an AUTHENTICATE message
+var micOffset = binary.Size(&authenticateMessageFields{}) + binary.Size(Version{})
+
 type authenticateMessageFields struct {
 	messageHeader
-	LmChallengeResponse varField
-	NtChallengeResponse varField
-	TargetName          varField
-	UserName            varField
-	Workstation         varField
-	_                   [8]byte
-	NegotiateFlags      negotiateFlags
+	LmChallengeResponse       varField
+	NtChallengeResponse       varField
+	DomainName                varField
+	UserName                  varField
+	Workstation               varField
+	EncryptedRandomSessionKey varField
+	NegotiateFlags            NegotiateFlags
 }
 
-func (m authenicateMessage) MarshalBinary() ([]byte, error) {
-	if !m.NegotiateFlags.Has(negotiateFlagNTLMSSPNEGOTIATEUNICODE) {
-		log.Printf("[DEBUG]%s only unicode is supported", CallerInfo())
-		return nil, errors.New("only unicode is supported")
+// MarshalBinary encodes the message. The Version field is written when set or
+// when a MIC is present, as the MIC follows it.
+func (m AuthenticateMessage) MarshalBinary() ([]byte, error) {
+	var domain, user, workstation []byte
+	switch {
+	case m.NegotiateFlags.Has(negotiateFlagNTLMSSPNEGOTIATEUNICODE):
+		domain, user = toUnicode(m.DomainName), toUnicode(m.UserName)
+		workstation = toUnicode(m.Workstation)
+	case m.NegotiateFlags.Has(negotiateFlagNTLMNEGOTIATEOEM):
+		var err error
+		if domain, err = m.CodePage.encodeString(m.DomainName); err != nil {
+			return nil, err
+		}
+		if user, err = m.CodePage.encodeString(m.UserName); err != nil {
+			return nil, err
+		}
+		if workstation, err = m.CodePage.encodeString(m.Workstation); err != nil {
+			return nil, err
+		}
+	default:
+		logger().Debug("neither unicode nor oem encoding negotiated")
+		return nil, ErrNoEncodingNegotiated
 	}
 
-	target, user := toUnicode(m.TargetName), toUnicode(m.UserName)
-	workstation := toUnicode("")
-
 	ptr := binary.Size(&authenticateMessageFields{})
+	if m.Version != nil || m.MIC != nil {
+		ptr += binary.Size(Version{})
+	}
+	if m.MIC != nil {
+		ptr += 16
+	}
 	f := authenticateMessageFields{
-		messageHeader:       newMessageHeader(3),
-		NegotiateFlags:      m.NegotiateFlags,
-		LmChallengeResponse: newVarField(&ptr, len(m.LmChallengeResponse)),
-		NtChallengeResponse: newVarField(&ptr, len(m.NtChallengeResponse)),
-		TargetName:          newVarField(&ptr, len(target)),
-		UserName:            newVarField(&ptr, len(user)),
-		Workstation:         newVarField(&ptr, len(workstation)),
+		messageHeader:  newMessageHeader(3),
+		NegotiateFlags: m.NegotiateFlags,
+	}
+	// the payload is in the order of Windows clients, MS-NLMP 4.2.4.3
+	f.DomainName = newVarField(&ptr, len(domain))
+	f.UserName = newVarField(&ptr, len(user))
+	f.Workstation = newVarField(&ptr, len(workstation))
+	f.LmChallengeResponse = newVarField(&ptr, len(m.LmChallengeResponse))
+	f.NtChallengeResponse = newVarField(&ptr, len(m.NtChallengeResponse))
+	f.EncryptedRandomSessionKey = newVarField(&ptr, len(m.EncryptedRandomSessionKey))
+
+	if m.Version == nil {
+		f.NegotiateFlags.Unset(negotiateFlagNTLMSSPNEGOTIATEVERSION)
 	}
-
-	f.NegotiateFlags.Unset(negotiateFlagNTLMSSPNEGOTIATEVERSION)
 
 	b := bytes.Buffer{}
 	if err := binary.Write(&b, binary.LittleEndian, &f); err != nil {
-		log.Printf("[DEBUG]%s error writing f in buffer: %s", CallerInfo(), err.Error())
+		logger().Debug("error writing f in buffer", "error", err)
 		return nil, err
 	}
-	if err := binary.Write(&b, binary.LittleEndian, &m.LmChallengeResponse); err != nil {
-		log.Printf("[DEBUG]%s error writing lm challenge response in buffer: %s", CallerInfo(), err.Error())
-		return nil, err
+	if m.Version != nil || m.MIC != nil {
+		var version Version
+		if m.Version != nil {
+			version = *m.Version
+		}
+		if err := binary.Write(&b, binary.LittleEndian, &version); err != nil {
+			logger().Debug("error writing version in buffer", "error", err)
+			return nil, err
+		}
 	}
-	if err := binary.Write(&b, binary.LittleEndian, &m.NtChallengeResponse); err != nil {
-		log.Printf("[DEBUG]%s error writing nt challenge response in buffer: %s", CallerInfo(), err.Error())
-		return nil, err
+	if m.MIC != nil {
+		mic := [16]byte{}
+		copy(mic[:], m.MIC)
+		if err := binary.Write(&b, binary.LittleEndian, &mic); err != nil {
+			logger().Debug("error writing mic in buffer", "error", err)
+			return nil, err
+		}
 	}
-	if err := binary.Write(&b, binary.LittleEndian, &target); err != nil {
-		log.Printf("[DEBUG]%s error writing target in buffer: %s", CallerInfo(), err.Error())
+	if err := binary.Write(&b, binary.LittleEndian, &domain); err != nil {
+		logger().Debug("error writing domain in buffer", "error", err)
 		return nil, err
 	}
 	if err := binary.Write(&b, binary.LittleEndian, &user); err != nil {
-		log.Printf("[DEBUG]%s error writing user in buffer: %s", CallerInfo(), err.Error())
+		logger().Debug("error writing user in buffer", "error", err)
 		return nil, err
 	}
 	if err := binary.Write(&b, binary.LittleEndian, &workstation); err != nil {
-		log.Printf("[DEBUG]%s error writing workstation in buffer: %s", CallerInfo(), err.Error())
+		logger().Debug("error writing workstation in buffer", "error", err)
+		return nil, err
+	}
+	if err := binary.Write(&b, binary.LittleEndian, &m.LmChallengeResponse); err != nil {
+		logger().Debug("error writing lm challenge response in buffer", "error", err)
+		return nil, err
+	}
+	if err := binary.Write(&b, binary.LittleEndian, &m.NtChallengeResponse); err != nil {
+		logger().Debug("error writing nt challenge response in buffer", "error", err)
+		return nil, err
+	}
+	if err := binary.Write(&b, binary.LittleEndian, &m.EncryptedRandomSessionKey); err != nil {
+		logger().Debug("error writing encrypted random session key in buffer", "error", err)
 		return nil, err
 	}
 
 	return b.Bytes(), nil
 }
 
-// ProcessChallenge crafts an AUTHENTICATE message in response to the CHALLENGE message
-// that was received from the server
-func ProcessChallenge(challengeMessageData []byte, user, password string, domainNeeded bool) ([]byte, error) {
-	if user == "" && password == "" {
-		log.Printf("[DEBUG]%s anonymous authentication not supported", CallerInfo())
-		return nil, errors.New("anonymous authentication not supported")
+// UnmarshalBinary decodes an AUTHENTICATE message, with the code page already
+// set in m. The byte slices of the decoded message refer to data, and Version
+// is only set when the message has room for it and it is not all zeros.
+func (m *AuthenticateMessage) UnmarshalBinary(data []byte) error {
+	var f authenticateMessageFields
+	r := bytes.NewReader(data)
+	err := binary.Read(r, binary.LittleEndian, &f)
+	if err != nil {
+		logger().Debug("error reading authenticate message fields", "error", err)
+		return fmt.Errorf("%w: %w", ErrInvalidMessage, err)
 	}
+	if !f.messageHeader.IsValid() || f.MessageType != 3 {
+		logger().Debug("message is not a valid authenticate message", "signature", string(f.Signature[:]), "type", f.MessageType)
+		return fmt.Errorf("%w: not an authenticate message (type %d)", ErrInvalidMessage, f.MessageType)
+	}
+	*m = AuthenticateMessage{NegotiateFlags: f.NegotiateFlags, CodePage: m.CodePage}
 
-	var cm challengeMessage
-	if err := cm.UnmarshalBinary(challengeMessageData); err != nil {
-		log.Printf("[DEBUG]%s failed unmarsheling challenge message data: %s", CallerInfo(), err.Error())
-		return nil, err
+	if m.LmChallengeResponse, err = f.LmChallengeResponse.ReadFrom(data); err != nil {
+		return err
+	}
+	if m.NtChallengeResponse, err = f.NtChallengeResponse.ReadFrom(data); err != nil {
+		return err
+	}
+	if m.EncryptedRandomSessionKey, err = f.EncryptedRandomSessionKey.ReadFrom(data); err != nil {
+		return err
+	}
+	unicode := m.NegotiateFlags.Has(negotiateFlagNTLMSSPNEGOTIATEUNICODE)
+	if m.DomainName, err = f.DomainName.ReadStringFrom(data, unicode, m.CodePage); err != nil {
+		return err
+	}
+	if m.UserName, err = f.UserName.ReadStringFrom(data, unicode, m.CodePage); err != nil {
+		return err
+	}
+	if m.Workstation, err = f.Workstation.ReadStringFrom(data, unicode, m.CodePage); err != nil {
+		return err
 	}
 
-	if cm.NegotiateFlags.Has(negotiateFlagNTLMSSPNEGOTIATELMKEY) {
-		log.Printf("[DEBUG]%s only ntlm v2 is supported, but server requested v1", CallerInfo())
-		return nil, errors.New("only ntlm v2 is supported, but server requested v1 (NTLMSSP_NEGOTIATE_LM_KEY)")
+	// version and MIC are present when the payload starts after them
+	offset := payloadOffset(data, f.LmChallengeResponse, f.NtChallengeResponse, f.DomainName,
+		f.UserName, f.Workstation, f.EncryptedRandomSessionKey)
+	if offset >= uint32(micOffset) {
+		if m.Version, err = readVersion(r); err != nil {
+			return err
+		}
 	}
-	if cm.NegotiateFlags.Has(negotiateFlagNTLMSSPNEGOTIATEKEYEXCH) {
-		log.Printf("[DEBUG]%s key exchange requested but not supported", CallerInfo())
-		return nil, errors.New("key exchange requested but not supported (NTLMSSP_NEGOTIATE_KEY_EXCH)")
+	if offset >= uint32(micOffset+16) {
+		m.MIC = data[micOffset : micOffset+16]
 	}
+	return nil
+}
+
+// ProcessChallenge crafts an AUTHENTICATE message in response to the CHALLENGE message
+// that was received from the server
+func ProcessChallenge(challengeMessageData []byte, user, password string, domainNeeded bool) ([]byte, error) {
+	am, _, err := ProcessChallengeWithSessionKey(challengeMessageData, user, password, domainNeeded)
+	return am, err
+}
+
+// ProcessChallengeWithSessionKey works like ProcessChallenge, but also returns the
+// exported session key established by the handshake. When the server requested
+// NTLMSSP_NEGOTIATE_KEY_EXCH, the key is random and sent RC4 encrypted in the
+// AUTHENTICATE message, otherwise it is the key exchange key.
+func ProcessChallengeWithSessionKey(challengeMessageData []byte, user, password string, domainNeeded bool) ([]byte, []byte, error) {
+	return ProcessChallengeWithOptions(challengeMessageData, user, password, domainNeeded, ChallengeOptions{})
+}
+
+// ChallengeOptions holds optional inputs used when crafting an AUTHENTICATE message.
+type ChallengeOptions struct {
+	// NegotiateMessage is the NEGOTIATE message that was sent to the server. When set,
+	// and the server sent a timestamp in its target info, a MIC is computed over
+	// the NEGOTIATE, CHALLENGE and AUTHENTICATE messages.
+	NegotiateMessage []byte
+
+	// ChannelBindings, when set, are hashed into a MsvAvChannelBindings AV pair of the
+	// NTLMv2 response, binding the authentication to the outer (TLS) channel.
+	ChannelBindings *ChannelBindings
+
+	// CodePage encodes the strings of the messages when the server does not
+	// negotiate Unicode, CodePage437 if nil.
+	CodePage *CodePage
+
+	// InsecureNTLMv1 computes NTLMv1 responses instead of NTLMv2: NTLM2 session
+	// responses when the server negotiates extended session security, NTLMv1
+	// and LM responses otherwise. These are easily cracked, only set it to
+	// authenticate to legacy servers that refuse NTLMv2.
+	InsecureNTLMv1 bool
+
+	// Workstation is the name of the client machine sent in the AUTHENTICATE
+	// message, it shows in the logon events of the server
+	Workstation string
+
+	// Version is sent when the server negotiates NTLMSSP_NEGOTIATE_VERSION,
+	// DefaultVersion() if nil
+	Version *Version
+
+	// Anonymous authenticates as the anonymous user (null session), with empty
+	// responses and the NTLMSSP_ANONYMOUS flag. The user and password are ignored.
+	Anonymous bool
+
+	// Domain is the domain of the user when domainNeeded is set, the target
+	// name of the server if empty
+	Domain string
+
+	// Rand is the source of the client challenge and of the exported session
+	// key, crypto/rand.Reader if nil. Its errors fail the handshake.
+	Rand io.Reader
+
+	// Now returns the time of the NTLMv2 response when the server did not send
+	// its own, time.Now if nil. Set it with Rand for reproducible messages.
+	Now func() time.Time
+
+	// logger of the handshake, the package logger if nil
+	logger *slog.Logger
+}
 
-	if !domainNeeded {
-		cm.TargetName = ""
+func (opts ChallengeOptions) log() *slog.Logger {
+	return loggerOr(opts.logger)
+}
+
+func (opts ChallengeOptions) now() time.Time {
+	if opts.Now == nil {
+		return time.Now()
 	}
+	return opts.Now()
+}
 
-	am := authenicateMessage{
-		UserName:       user,
-		TargetName:     cm.TargetName,
-		NegotiateFlags: cm.NegotiateFlags,
+// ProcessChallengeWithOptions works like ProcessChallengeWithSessionKey, using the
+// additional inputs from opts.
+func ProcessChallengeWithOptions(challengeMessageData []byte, user, password string, domainNeeded bool, opts ChallengeOptions) ([]byte, []byte, error) {
+	if user == "" && password == "" && !opts.Anonymous {
+		logger().Debug("anonymous authentication not enabled")
+		return nil, nil, handshakeError(StageAuthenticate, 0, 0, ErrAnonymousNotSupported)
 	}
 
-	timestamp := cm.TargetInfo[avIDMsvAvTimestamp]
-	if timestamp == nil { // no time sent, take current time
-		ft := uint64(time.Now().UnixNano()) / 100
-		ft += 116444736000000000 // add time between unix & windows offset
-		timestamp = make([]byte, 8)
-		binary.LittleEndian.PutUint64(timestamp, ft)
+	var lmHash []byte
+	if opts.InsecureNTLMv1 {
+		lmHash = getLmHash(password, opts.CodePage)
 	}
+	return processChallenge(challengeMessageData, user, getNtlmHash(password), lmHash, domainNeeded, opts)
+}
 
-	clientChallenge := make([]byte, 8)
-	rand.Reader.Read(clientChallenge)
+func ProcessChallengeWithHash(challengeMessageData []byte, user, hash string) ([]byte, error) {
+	am, _, err := ProcessChallengeWithHashAndSessionKey(challengeMessageData, user, hash)
+	return am, err
+}
 
-	ntlmV2Hash := getNtlmV2Hash(password, user, cm.TargetName)
+// ProcessChallengeWithHashAndSessionKey works like ProcessChallengeWithHash, but also
+// returns the exported session key established by the handshake.
+func ProcessChallengeWithHashAndSessionKey(challengeMessageData []byte, user, hash string) ([]byte, []byte, error) {
+	return ProcessChallengeWithHashAndOptions(challengeMessageData, user, hash, ChallengeOptions{})
+}
 
-	am.NtChallengeResponse = computeNtlmV2Response(ntlmV2Hash,
-		cm.ServerChallenge[:], clientChallenge, timestamp, cm.TargetInfoRaw)
+// ProcessChallengeWithHashAndOptions works like ProcessChallengeWithHashAndSessionKey,
+// using the additional inputs from opts.
+func ProcessChallengeWithHashAndOptions(challengeMessageData []byte, user, hash string, opts ChallengeOptions) ([]byte, []byte, error) {
+	if opts.Anonymous {
+		return processChallenge(challengeMessageData, "", nil, nil, true, opts)
+	}
+	if user == "" && hash == "" {
+		logger().Debug("anonymous authentication not enabled")
+		return nil, nil, handshakeError(StageAuthenticate, 0, 0, ErrAnonymousNotSupported)
+	}
 
-	if cm.TargetInfoRaw == nil {
-		am.LmChallengeResponse = computeLmV2Response(ntlmV2Hash,
-			cm.ServerChallenge[:], clientChallenge)
+	hashBytes, err := decodeNtlmHash(hash)
+	if err != nil {
+		return nil, nil, handshakeError(StageAuthenticate, 0, 0, err)
 	}
-	return am.MarshalBinary()
+
+	return processChallenge(challengeMessageData, user, hashBytes, nil, true, opts)
 }
 
-func ProcessChallengeWithHash(challengeMessageData []byte, user, hash string) ([]byte, error) {
-	if user == "" && hash == "" {
-		log.Printf("[DEBUG]%s anonymous authentication not supported", CallerInfo())
-		return nil, errors.New("anonymous authentication not supported")
+// decodeNtlmHash decodes a hex encoded NT hash, also accepting the LM:NT form
+func decodeNtlmHash(hash string) ([]byte, error) {
+	hashParts := strings.Split(hash, ":")
+	if len(hashParts) > 1 {
+		hash = hashParts[1]
+	}
+	// the hex decoding error would quote the hash
+	hashBytes, err := hex.DecodeString(hash)
+	if err != nil || len(hashBytes) != 16 {
+		logger().Debug("failed decoding hash")
+		return nil, ErrInvalidHash
 	}
+	return hashBytes, nil
+}
 
+func processChallenge(challengeMessageData []byte, user string, ntHash, lmHash []byte, domainNeeded bool, opts ChallengeOptions) ([]byte, []byte, error) {
 	var cm challengeMessage
+	cm.CodePage = opts.CodePage
 	if err := cm.UnmarshalBinary(challengeMessageData); err != nil {
-		log.Printf("[DEBUG]%s failed unmarshaling challenge message data: %s", CallerInfo(), err.Error())
-		return nil, err
+		opts.log().Debug("failed unmarshaling challenge message data", "error", err)
+		return nil, nil, handshakeError(StageChallenge, 0, 0, err)
 	}
 
-	if cm.NegotiateFlags.Has(negotiateFlagNTLMSSPNEGOTIATELMKEY) {
-		log.Printf("[DEBUG]%s only ntlm v2 is supported, but server requested v1", CallerInfo())
-		return nil, errors.New("only ntlm v2 is supported, but server requested v1 (NTLMSSP_NEGOTIATE_LM_KEY)")
+	if cm.NegotiateFlags.Has(negotiateFlagNTLMSSPNEGOTIATELMKEY) && !opts.InsecureNTLMv1 {
+		opts.log().Debug("only ntlm v2 is supported, but server requested v1")
+		return nil, nil, handshakeError(StageChallenge, cm.NegotiateFlags, 0,
+			fmt.Errorf("%w, but server requested v1 (NTLMSSP_NEGOTIATE_LM_KEY)", ErrNTLMv1NotSupported))
 	}
-	if cm.NegotiateFlags.Has(negotiateFlagNTLMSSPNEGOTIATEKEYEXCH) {
-		log.Printf("[DEBUG]%s key exchange requested but not supported", CallerInfo())
-		return nil, errors.New("key exchange requested but not supported (NTLMSSP_NEGOTIATE_KEY_EXCH)")
+
+	domain := cm.TargetName
+	if opts.Domain != "" {
+		domain = opts.Domain
+	}
+	if !domainNeeded || opts.Anonymous {
+		domain = ""
 	}
 
-	am := authenicateMessage{
+	am := AuthenticateMessage{
 		UserName:       user,
-		TargetName:     cm.TargetName,
+		DomainName:     domain,
+		Workstation:    opts.Workstation,
 		NegotiateFlags: cm.NegotiateFlags,
+		CodePage:       opts.CodePage,
+	}
+	if cm.NegotiateFlags.Has(negotiateFlagNTLMSSPNEGOTIATEVERSION) {
+		version := DefaultVersion()
+		if opts.Version != nil {
+			version = *opts.Version
+		}
+		am.Version = &version
 	}
 
-	timestamp := cm.TargetInfo[avIDMsvAvTimestamp]
-	if timestamp == nil { // no time sent, take current time
-		ft := uint64(time.Now().UnixNano()) / 100
-		ft += 116444736000000000 // add time between unix & windows offset
-		timestamp = make([]byte, 8)
-		binary.LittleEndian.PutUint64(timestamp, ft)
+	clientChallenge, err := generateClientChallenge(opts.Rand)
+	if err != nil {
+		opts.log().Debug("error generating client challenge", "error", err)
+		return nil, nil, handshakeError(StageAuthenticate, cm.NegotiateFlags, 0, err)
 	}
 
-	clientChallenge := make([]byte, 8)
-	rand.Reader.Read(clientChallenge)
+	var keyExchangeKey []byte
+	computeMIC := false
+	switch {
+	case opts.Anonymous:
+		// MS-NLMP 3.3.2, no NT response, a single zero byte as LM response
+		opts.log().Debug("authenticating anonymously")
+		am.UserName = ""
+		am.NegotiateFlags |= negotiateFlagANONYMOUS
+		am.LmChallengeResponse = []byte{0}
+		keyExchangeKey = make([]byte, 16)
+	case opts.InsecureNTLMv1:
+		opts.log().Warn("computing insecure ntlm v1 responses, only use them to migrate off legacy servers",
+			"flags", cm.NegotiateFlags.String(), "ntlm2_session", cm.NegotiateFlags.Has(negotiateFlagNTLMSSPNEGOTIATEEXTENDEDSESSIONSECURITY))
+		am.NtChallengeResponse, am.LmChallengeResponse, keyExchangeKey, err = computeNtlmV1Response(cm.NegotiateFlags,
+			ntHash, lmHash, cm.ServerChallenge[:], clientChallenge)
+		if err != nil {
+			return nil, nil, handshakeError(StageAuthenticate, cm.NegotiateFlags, 0, err)
+		}
+	default:
+		timestamp := cm.TargetInfoPairs.Get(MsvAvTimestamp)
+		serverTimestamp := timestamp != nil
+		if !serverTimestamp { // no time sent, take current time
+			timestamp = generateTimestamp(opts.now())
+		}
+
+		targetInfo := cm.TargetInfo
+		pairs := append(AVPairs{}, cm.TargetInfoPairs...)
+		computeMIC = opts.NegotiateMessage != nil && serverTimestamp
+		if computeMIC {
+			// announce the MIC to the server in the echoed target info
+			pairs.SetFlags(pairs.Flags() | AVFlagMICPresent)
+			am.MIC = make([]byte, 16)
+		}
+		if opts.ChannelBindings != nil && cm.TargetInfo != nil {
+			if err := pairs.SetChannelBindings(opts.ChannelBindings); err != nil {
+				opts.log().Debug("error hashing channel bindings", "error", err)
+				return nil, nil, handshakeError(StageAuthenticate, cm.NegotiateFlags, 0, err)
+			}
+		}
+		if computeMIC || opts.ChannelBindings != nil && cm.TargetInfo != nil {
+			if targetInfo, err = pairs.MarshalBinary(); err != nil {
+				return nil, nil, handshakeError(StageAuthenticate, cm.NegotiateFlags, 0, err)
+			}
+		}
+
+		ntlmV2Hash := hmacMd5(ntHash, toUnicode(strings.ToUpper(user)+domain))
+
+		am.NtChallengeResponse = computeNtlmV2Response(ntlmV2Hash,
+			cm.ServerChallenge[:], clientChallenge, timestamp, targetInfo)
+
+		// MS-NLMP 3.1.5.1.2, Z(24) instead of the LMv2 response when the
+		// server sent its time
+		am.LmChallengeResponse = make([]byte, 24)
+		if !serverTimestamp {
+			am.LmChallengeResponse = computeLmV2Response(ntlmV2Hash,
+				cm.ServerChallenge[:], clientChallenge)
+		}
+
+		keyExchangeKey = computeNtlmV2SessionBaseKey(ntlmV2Hash, am.NtChallengeResponse)
+	}
 
-	hashParts := strings.Split(hash, ":")
-	if len(hashParts) > 1 {
-		hash = hashParts[1]
+	exportedSessionKey := keyExchangeKey
+	if cm.NegotiateFlags.Has(negotiateFlagNTLMSSPNEGOTIATEKEYEXCH) {
+		exportedSessionKey, err = generateExportedSessionKey(opts.Rand)
+		if err != nil {
+			opts.log().Debug("error generating exported session key", "error", err)
+			return nil, nil, handshakeError(StageAuthenticate, cm.NegotiateFlags, 0, err)
+		}
+		am.EncryptedRandomSessionKey, err = rc4K(keyExchangeKey, exportedSessionKey)
+		if err != nil {
+			opts.log().Debug("error encrypting exported session key", "error", err)
+			return nil, nil, handshakeError(StageAuthenticate, cm.NegotiateFlags, 0, err)
+		}
 	}
-	hashBytes, err := hex.DecodeString(hash)
+
+	b, err := am.MarshalBinary()
 	if err != nil {
-		log.Printf("[DEBUG]%s failed decoding hash: %s", CallerInfo(), err.Error())
-		return nil, err
+		return nil, nil, handshakeError(StageAuthenticate, cm.NegotiateFlags, 0, err)
 	}
-	ntlmV2Hash := hmacMd5(hashBytes, toUnicode(strings.ToUpper(user)+cm.TargetName))
-
-	am.NtChallengeResponse = computeNtlmV2Response(ntlmV2Hash,
-		cm.ServerChallenge[:], clientChallenge, timestamp, cm.TargetInfoRaw)
-
-	if cm.TargetInfoRaw == nil {
-		am.LmChallengeResponse = computeLmV2Response(ntlmV2Hash,
-			cm.ServerChallenge[:], clientChallenge)
+	if computeMIC {
+		mic := hmacMd5(exportedSessionKey, opts.NegotiateMessage, challengeMessageData, b)
+		copy(b[micOffset:], mic)
 	}
-	return am.MarshalBinary()
+	return b, exportedSessionKey, nil
 }
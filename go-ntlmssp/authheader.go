@@ -2,7 +2,6 @@ package ntlmssp
 
 import (
 	"encoding/base64"
-	"log"
 	"strings"
 )
 
@@ -60,9 +59,13 @@ func (h authheader) GetData() ([]byte, error) {
 func (h authheader) GetBasicCreds() (username, password string, err error) {
 	d, err := h.GetData()
 	if err != nil {
-		log.Printf("[DEBUG]%s error getting auth header data: %s", CallerInfo(), err.Error())
+		logger().Debug("error getting auth header data", "error", err)
 		return "", "", err
 	}
-	parts := strings.SplitN(string(d), ":", 2)
-	return parts[0], parts[1], nil
+	username, password, ok := strings.Cut(string(d), ":")
+	if !ok {
+		logger().Debug("basic credentials without a colon")
+		return "", "", ErrInvalidBasicAuth
+	}
+	return username, password, nil
 }
@@ -1,17 +1,282 @@
 package ntlmssp
 
-type avID uint16
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// AVID identifies the value of an AV_PAIR, see https://msdn.microsoft.com/en-us/library/cc236646.aspx
+type AVID uint16
 
+// AV_PAIR identifiers
 const (
-	avIDMsvAvEOL avID = iota
-	avIDMsvAvNbComputerName
-	avIDMsvAvNbDomainName
-	avIDMsvAvDNSComputerName
-	avIDMsvAvDNSDomainName
-	avIDMsvAvDNSTreeName
-	avIDMsvAvFlags
-	avIDMsvAvTimestamp
-	avIDMsvAvSingleHost
-	avIDMsvAvTargetName
-	avIDMsvChannelBindings
+	MsvAvEOL AVID = iota
+	MsvAvNbComputerName
+	MsvAvNbDomainName
+	MsvAvDNSComputerName
+	MsvAvDNSDomainName
+	MsvAvDNSTreeName
+	MsvAvFlags
+	MsvAvTimestamp
+	MsvAvSingleHost
+	MsvAvTargetName
+	MsvAvChannelBindings
 )
+
+// AVFlags is the value of the MsvAvFlags pair.
+type AVFlags uint32
+
+// MsvAvFlags bits
+const (
+	// AVFlagAccountAuthenticationConstrained is set by the server when the
+	// account authentication is constrained
+	AVFlagAccountAuthenticationConstrained AVFlags = 1 << 0
+	// AVFlagMICPresent is set by the client when the AUTHENTICATE message carries a MIC
+	AVFlagMICPresent AVFlags = 1 << 1
+	// AVFlagUntrustedSPN is set by the client when the target name was
+	// supplied by an untrusted source
+	AVFlagUntrustedSPN AVFlags = 1 << 2
+)
+
+// Has reports whether all the bits of flags are set.
+func (field AVFlags) Has(flags AVFlags) bool {
+	return field&flags == flags
+}
+
+// AVPair is an AV_PAIR of a target info.
+type AVPair struct {
+	ID    AVID
+	Value []byte
+}
+
+// AVPairs is an AV_PAIR list, the target info of CHALLENGE messages and of
+// NTLMv2 responses, in the order of the message. The MsvAvEOL terminator is
+// not part of the list.
+type AVPairs []AVPair
+
+// maxAVPairs limits the length of the AV_PAIR lists we parse, servers send
+// about ten pairs
+const maxAVPairs = 64
+
+// SingleHostData is the value of the MsvAvSingleHost pair.
+type SingleHostData struct {
+	CustomData [8]byte
+	MachineID  [32]byte
+}
+
+// singleHostFields is the wire format of SingleHostData
+type singleHostFields struct {
+	Size uint32
+	_    uint32
+	SingleHostData
+}
+
+// MarshalBinary encodes the pairs followed by the MsvAvEOL terminator.
+func (p AVPairs) MarshalBinary() ([]byte, error) {
+	b := bytes.Buffer{}
+	for _, pair := range p {
+		if pair.ID == MsvAvEOL {
+			return nil, fmt.Errorf("%w: MsvAvEOL within the av pairs", ErrInvalidMessage)
+		}
+		if len(pair.Value) > 0xffff {
+			return nil, fmt.Errorf("%w: av pair %d of %d bytes", ErrInvalidMessage, pair.ID, len(pair.Value))
+		}
+		binary.Write(&b, binary.LittleEndian, pair.ID)
+		binary.Write(&b, binary.LittleEndian, uint16(len(pair.Value)))
+		b.Write(pair.Value)
+	}
+	binary.Write(&b, binary.LittleEndian, MsvAvEOL)
+	binary.Write(&b, binary.LittleEndian, uint16(0))
+	return b.Bytes(), nil
+}
+
+// UnmarshalBinary decodes an AV_PAIR list up to and excluding the MsvAvEOL
+// terminator, keeping the order and duplicates of the pairs. The values are
+// copied from data.
+func (p *AVPairs) UnmarshalBinary(data []byte) error {
+	var pairs AVPairs
+	d := append([]byte{}, data...)
+	for {
+		if len(d) < 4 {
+			logger().Debug("av pair list not terminated")
+			return fmt.Errorf("%w: av pair list not terminated by MsvAvEOL", ErrInvalidMessage)
+		}
+		id := AVID(binary.LittleEndian.Uint16(d))
+		l := int(binary.LittleEndian.Uint16(d[2:]))
+		d = d[4:]
+		if id == MsvAvEOL {
+			*p = pairs
+			return nil
+		}
+		if l > len(d) {
+			logger().Debug("short av pair", "id", id, "expected", l, "read", len(d))
+			return fmt.Errorf("%w: av pair value expected to be %d bytes, got only %d", ErrInvalidMessage, l, len(d))
+		}
+		if len(pairs) == maxAVPairs {
+			logger().Debug("too many av pairs")
+			return fmt.Errorf("%w: more than %d av pairs", ErrInvalidMessage, maxAVPairs)
+		}
+		pairs = append(pairs, AVPair{ID: id, Value: d[:l:l]})
+		d = d[l:]
+	}
+}
+
+// avPairSizes are the sizes of the AV pairs with a fixed size
+var avPairSizes = map[AVID]int{
+	MsvAvFlags:           4,
+	MsvAvTimestamp:       8,
+	MsvAvChannelBindings: 16,
+}
+
+// check rejects the pairs sent more than once, as the value used would
+// depend on the parser, and the pairs of the wrong size.
+func (p AVPairs) check() error {
+	seen := make(map[AVID]bool, len(p))
+	for _, pair := range p {
+		if seen[pair.ID] {
+			logger().Debug("duplicate av pair", "id", pair.ID)
+			return fmt.Errorf("%w: duplicate av pair %d", ErrInvalidMessage, pair.ID)
+		}
+		seen[pair.ID] = true
+		if size, ok := avPairSizes[pair.ID]; ok && len(pair.Value) != size {
+			logger().Debug("invalid av pair size", "id", pair.ID, "size", len(pair.Value))
+			return fmt.Errorf("%w: av pair %d expected to be %d bytes, got %d", ErrInvalidMessage, pair.ID, size, len(pair.Value))
+		}
+	}
+	return nil
+}
+
+// Get returns the value of the first pair with the given id, nil if there is none.
+func (p AVPairs) Get(id AVID) []byte {
+	for _, pair := range p {
+		if pair.ID == id {
+			return pair.Value
+		}
+	}
+	return nil
+}
+
+// Set replaces the value of the first pair with the given id, or appends a
+// new pair to the list.
+func (p *AVPairs) Set(id AVID, value []byte) {
+	for i := range *p {
+		if (*p)[i].ID == id {
+			(*p)[i].Value = value
+			return
+		}
+	}
+	*p = append(*p, AVPair{ID: id, Value: value})
+}
+
+// Delete removes the pairs with the given id.
+func (p *AVPairs) Delete(id AVID) {
+	pairs := (*p)[:0]
+	for _, pair := range *p {
+		if pair.ID != id {
+			pairs = append(pairs, pair)
+		}
+	}
+	*p = pairs
+}
+
+// GetString returns the UTF-16LE value of the first pair with the given id,
+// empty if there is none or it is not valid.
+func (p AVPairs) GetString(id AVID) string {
+	s, _ := fromUnicode(p.Get(id))
+	return s
+}
+
+// SetString sets the value of the pair with the given id to s, UTF-16LE encoded.
+func (p *AVPairs) SetString(id AVID, s string) {
+	p.Set(id, toUnicode(s))
+}
+
+// NbComputerName returns the NetBIOS name of the server.
+func (p AVPairs) NbComputerName() string { return p.GetString(MsvAvNbComputerName) }
+
+// NbDomainName returns the NetBIOS name of the domain of the server.
+func (p AVPairs) NbDomainName() string { return p.GetString(MsvAvNbDomainName) }
+
+// DNSComputerName returns the fully qualified domain name of the server.
+func (p AVPairs) DNSComputerName() string { return p.GetString(MsvAvDNSComputerName) }
+
+// DNSDomainName returns the DNS name of the domain of the server.
+func (p AVPairs) DNSDomainName() string { return p.GetString(MsvAvDNSDomainName) }
+
+// DNSTreeName returns the DNS name of the forest of the server.
+func (p AVPairs) DNSTreeName() string { return p.GetString(MsvAvDNSTreeName) }
+
+// TargetName returns the service principal name the client authenticates to.
+func (p AVPairs) TargetName() string { return p.GetString(MsvAvTargetName) }
+
+// Flags returns the value of the MsvAvFlags pair, zero if there is none.
+func (p AVPairs) Flags() AVFlags {
+	v := p.Get(MsvAvFlags)
+	if len(v) != 4 {
+		return 0
+	}
+	return AVFlags(binary.LittleEndian.Uint32(v))
+}
+
+// SetFlags sets the value of the MsvAvFlags pair.
+func (p *AVPairs) SetFlags(flags AVFlags) {
+	v := make([]byte, 4)
+	binary.LittleEndian.PutUint32(v, uint32(flags))
+	p.Set(MsvAvFlags, v)
+}
+
+// Timestamp returns the time of the server in the MsvAvTimestamp pair, false
+// if there is none.
+func (p AVPairs) Timestamp() (time.Time, bool) {
+	v := p.Get(MsvAvTimestamp)
+	if len(v) != 8 {
+		return time.Time{}, false
+	}
+	return parseTimestamp(v), true
+}
+
+// SetTimestamp sets the MsvAvTimestamp pair to t.
+func (p *AVPairs) SetTimestamp(t time.Time) {
+	p.Set(MsvAvTimestamp, generateTimestamp(t))
+}
+
+// SingleHost returns the value of the MsvAvSingleHost pair, false if there is
+// none or it is not valid.
+func (p AVPairs) SingleHost() (SingleHostData, bool) {
+	var f singleHostFields
+	v := p.Get(MsvAvSingleHost)
+	if len(v) < binary.Size(&f) {
+		return SingleHostData{}, false
+	}
+	binary.Read(bytes.NewReader(v), binary.LittleEndian, &f)
+	if int(f.Size) != binary.Size(&f) {
+		return SingleHostData{}, false
+	}
+	return f.SingleHostData, true
+}
+
+// SetSingleHost sets the MsvAvSingleHost pair to data.
+func (p *AVPairs) SetSingleHost(data SingleHostData) {
+	f := singleHostFields{Size: uint32(binary.Size(&singleHostFields{})), SingleHostData: data}
+	b := bytes.Buffer{}
+	binary.Write(&b, binary.LittleEndian, &f)
+	p.Set(MsvAvSingleHost, b.Bytes())
+}
+
+// ChannelBindings returns the MD5 hash of the channel bindings in the
+// MsvAvChannelBindings pair, nil if there is none.
+func (p AVPairs) ChannelBindings() []byte {
+	return p.Get(MsvAvChannelBindings)
+}
+
+// SetChannelBindings sets the MsvAvChannelBindings pair to the hash of cb.
+func (p *AVPairs) SetChannelBindings(cb *ChannelBindings) error {
+	v, err := cb.hash()
+	if err != nil {
+		return err
+	}
+	p.Set(MsvAvChannelBindings, v)
+	return nil
+}
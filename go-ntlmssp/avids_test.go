@@ -0,0 +1,104 @@
+package ntlmssp
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// marshalAVPairs encodes pairs built by the tests
+func marshalAVPairs(pairs AVPairs) []byte {
+	b, err := pairs.MarshalBinary()
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func TestAVPairs(t *testing.T) {
+	// MS-NLMP 4.2.4, the time is 0x01c334b736d39000 as FILETIME
+	timestamp := time.Date(2003, time.June, 17, 10, 0, 0, 0, time.UTC)
+	host := SingleHostData{CustomData: [8]byte{1, 2, 3, 4, 5, 6, 7, 8}, MachineID: [32]byte{0xaa, 0xbb}}
+	cb := &ChannelBindings{ApplicationData: []byte("tls-server-end-point:0123456789abcdef")}
+
+	var pairs AVPairs
+	if err := pairs.UnmarshalBinary(nlmpTargetInfo); err != nil {
+		t.Fatalf("error parsing target info: %s", err)
+	}
+	if pairs.NbDomainName() != nlmpUserDom || pairs.NbComputerName() != nlmpServerName {
+		t.Fatalf("expected names %q and %q, got %q and %q", nlmpUserDom, nlmpServerName, pairs.NbDomainName(), pairs.NbComputerName())
+	}
+	if _, ok := pairs.Timestamp(); ok || pairs.Flags() != 0 {
+		t.Fatalf("expected no timestamp nor flags in %v", pairs)
+	}
+
+	pairs.SetString(MsvAvDNSComputerName, "server.domain.com")
+	pairs.SetString(MsvAvDNSDomainName, "domain.com")
+	pairs.SetString(MsvAvDNSTreeName, "forest.com")
+	pairs.SetString(MsvAvTargetName, "HTTP/server.domain.com")
+	pairs.SetTimestamp(timestamp)
+	pairs.SetFlags(AVFlagMICPresent)
+	pairs.SetSingleHost(host)
+	if err := pairs.SetChannelBindings(cb); err != nil {
+		t.Fatalf("error setting channel bindings: %s", err)
+	}
+	pairs = append(pairs, AVPair{ID: MsvAvNbDomainName, Value: toUnicode("OTHER")})
+
+	b, err := pairs.MarshalBinary()
+	if err != nil {
+		t.Fatalf("error marshaling target info: %s", err)
+	}
+	var parsed AVPairs
+	if err := parsed.UnmarshalBinary(b); err != nil {
+		t.Fatalf("error parsing target info: %s", err)
+	}
+	if !reflect.DeepEqual(parsed, pairs) {
+		t.Fatalf("expected %v, got %v", pairs, parsed)
+	}
+	if !errors.Is(parsed.check(), ErrInvalidMessage) {
+		t.Fatalf("expected duplicate pairs to be invalid")
+	}
+
+	if v := parsed.Get(MsvAvTimestamp); !bytes.Equal(v, []byte{0x00, 0x90, 0xd3, 0x36, 0xb7, 0x34, 0xc3, 0x01}) {
+		t.Fatalf("unexpected timestamp %x", v)
+	}
+	if ts, ok := parsed.Timestamp(); !ok || !ts.Equal(timestamp) {
+		t.Fatalf("expected timestamp %s, got %s", timestamp, ts)
+	}
+	if !parsed.Flags().Has(AVFlagMICPresent) || parsed.Flags().Has(AVFlagUntrustedSPN) {
+		t.Fatalf("unexpected flags %b", parsed.Flags())
+	}
+	if v, ok := parsed.SingleHost(); !ok || v != host {
+		t.Fatalf("expected single host %v, got %v", host, v)
+	}
+	if expected, _ := cb.hash(); !bytes.Equal(parsed.ChannelBindings(), expected) {
+		t.Fatalf("expected channel bindings %x, got %x", expected, parsed.ChannelBindings())
+	}
+	for _, table := range []struct{ v, expected string }{
+		{parsed.NbDomainName(), nlmpUserDom},
+		{parsed.DNSComputerName(), "server.domain.com"},
+		{parsed.DNSDomainName(), "domain.com"},
+		{parsed.DNSTreeName(), "forest.com"},
+		{parsed.TargetName(), "HTTP/server.domain.com"},
+	} {
+		if table.v != table.expected {
+			t.Fatalf("expected %q, got %q", table.expected, table.v)
+		}
+	}
+
+	parsed.Delete(MsvAvNbDomainName)
+	if parsed.Get(MsvAvNbDomainName) != nil || len(parsed) != len(pairs)-2 {
+		t.Fatalf("expected the domain names to be deleted from %v", parsed)
+	}
+
+	for _, invalid := range []AVPairs{
+		{{ID: MsvAvEOL}},
+		{{ID: MsvAvTargetName, Value: make([]byte, 0x10000)}},
+	} {
+		if _, err := invalid.MarshalBinary(); !errors.Is(err, ErrInvalidMessage) {
+			t.Fatalf("expected %v, got %v", ErrInvalidMessage, err)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package ntlmssp
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+)
+
+// requestBody sends a request, and its body, for the legs of a handshake.
+// The body is read again from req.GetBody each time it is sent again, and is
+// only buffered when the request has no GetBody.
+//
+// With probe set, the legs that may be answered with a challenge are sent as
+// HEAD requests without body, and the request is sent once, on the
+// authenticated connection.
+type requestBody struct {
+	getBody func() (io.ReadCloser, error)
+	hasBody bool
+	probe   bool
+	sent    bool
+	logger  *slog.Logger
+}
+
+func newRequestBody(req *http.Request, probe bool, logger *slog.Logger) (*requestBody, error) {
+	b := &requestBody{getBody: req.GetBody, logger: logger}
+	if req.Body == nil || req.Body == http.NoBody {
+		return b, nil
+	}
+	b.hasBody = true
+	b.probe = probe
+	if b.getBody != nil || probe {
+		return b, nil
+	}
+
+	// no way to read the body again, keep a copy
+	body := bytes.Buffer{}
+	_, err := body.ReadFrom(req.Body)
+	if err != nil {
+		logger.Debug("error reading req body", "error", err)
+		return nil, err
+	}
+	req.Body.Close()
+	req.Body = ioutil.NopCloser(bytes.NewReader(body.Bytes()))
+	b.getBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body.Bytes())), nil
+	}
+	return b, nil
+}
+
+// replayable reports whether the request can still be sent with its body.
+func (b *requestBody) replayable() bool {
+	return !b.hasBody || !b.sent || b.getBody != nil
+}
+
+// send sends req with its body.
+func (b *requestBody) send(rt http.RoundTripper, req *http.Request) (*http.Response, error) {
+	if b.hasBody && b.sent {
+		if b.getBody == nil {
+			b.logger.Debug("request body cannot be sent again")
+			return nil, ErrBodyNotReplayable
+		}
+		body, err := b.getBody()
+		if err != nil {
+			b.logger.Debug("error getting req body", "error", err)
+			return nil, err
+		}
+		req.Body = body
+	}
+	b.sent = true
+	return rt.RoundTrip(req)
+}
+
+// probeOrSend sends a leg that may be answered with a challenge. With probe,
+// a HEAD request is sent in place of req, and req is only sent if the probe
+// was not asked to authenticate.
+func (b *requestBody) probeOrSend(rt http.RoundTripper, req *http.Request) (*http.Response, error) {
+	if !b.probe || b.sent {
+		return b.send(rt, req)
+	}
+
+	// shares the headers of req, which carry the authorization
+	head := req.WithContext(req.Context())
+	head.Method = http.MethodHead
+	head.Body, head.GetBody, head.ContentLength = nil, nil, 0
+	res, err := rt.RoundTrip(head)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusProxyAuthRequired {
+		return res, nil
+	}
+	io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+	return b.send(rt, req)
+}
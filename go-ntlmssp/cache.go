@@ -0,0 +1,190 @@
+package ntlmssp
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+)
+
+// HandshakeCache lets a Negotiator skip handshakes. It remembers the hosts
+// asking for NTLM/Negotiate authentication, so requests to them are
+// authenticated right away instead of being sent anonymously first, and it
+// keeps the connections authenticated by a handshake, so later requests with
+// the same credentials are sent on them without a new handshake.
+//
+// Connections can only be kept when the RoundTripper of the Negotiator is a
+// *http.Transport. The cache is not used for requests going through a proxy
+// that asks for authentication (ProxyCredentials).
+//
+// A HandshakeCache is safe for concurrent use. Share one between the
+// Negotiators using the same RoundTripper, not between different transports.
+type HandshakeCache struct {
+	// MaxIdleConns limits the idle authenticated connections kept for each
+	// host and credentials, 2 if zero
+	MaxIdleConns int
+
+	mu    sync.Mutex
+	hosts map[string]authheader
+	idle  map[string][]*handshakeConn
+
+	handshakes        uint64
+	probesSkipped     uint64
+	connectionsReused uint64
+}
+
+// HandshakeStats counts what a HandshakeCache saved.
+type HandshakeStats struct {
+	// Handshakes is the number of handshakes performed
+	Handshakes uint64
+
+	// ProbesSkipped is the number of anonymous requests not sent, since the
+	// host was known to ask for authentication
+	ProbesSkipped uint64
+
+	// ConnectionsReused is the number of requests sent on an authenticated
+	// connection, each one a handshake avoided
+	ConnectionsReused uint64
+}
+
+// NewHandshakeCache returns an empty cache.
+func NewHandshakeCache() *HandshakeCache {
+	return &HandshakeCache{}
+}
+
+// Stats returns the counters of the cache.
+func (c *HandshakeCache) Stats() HandshakeStats {
+	return HandshakeStats{
+		Handshakes:        atomic.LoadUint64(&c.handshakes),
+		ProbesSkipped:     atomic.LoadUint64(&c.probesSkipped),
+		ConnectionsReused: atomic.LoadUint64(&c.connectionsReused),
+	}
+}
+
+// CloseIdleConnections closes the idle authenticated connections. The hosts
+// asking for authentication are still remembered.
+func (c *HandshakeCache) CloseIdleConnections() {
+	c.mu.Lock()
+	idle := c.idle
+	c.idle = nil
+	c.mu.Unlock()
+	for _, conns := range idle {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}
+}
+
+// The methods below accept a nil cache, so the Negotiator does not have to
+// check whether it has one.
+
+// host returns the challenge header a host answered with, if it asked for authentication.
+func (c *HandshakeCache) host(u *url.URL) (authheader, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	resauth, ok := c.hosts[hostKey(u)]
+	return resauth, ok
+}
+
+// setHost remembers that a host asked for authentication with resauth.
+func (c *HandshakeCache) setHost(u *url.URL, resauth authheader) {
+	if c == nil {
+		return
+	}
+	// keep the mechanism name only, the token belongs to this handshake
+	mech := authheader{"Negotiate"}
+	if resauth.IsNTLM() {
+		mech = authheader{"NTLM"}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.hosts == nil {
+		c.hosts = make(map[string]authheader)
+	}
+	c.hosts[hostKey(u)] = mech
+}
+
+// get takes an idle connection authenticated for key, or returns nil.
+func (c *HandshakeCache) get(key string) *handshakeConn {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	conns := c.idle[key]
+	if len(conns) == 0 {
+		return nil
+	}
+	conn := conns[len(conns)-1]
+	c.idle[key] = conns[:len(conns)-1]
+	return conn
+}
+
+// put returns an authenticated connection to the cache, or closes it when the
+// cache is full or it cannot be reused.
+func (c *HandshakeCache) put(key string, conn *handshakeConn) {
+	if c == nil || !conn.pinned {
+		conn.Close()
+		return
+	}
+	max := c.MaxIdleConns
+	if max == 0 {
+		max = 2
+	}
+	c.mu.Lock()
+	if len(c.idle[key]) >= max {
+		c.mu.Unlock()
+		conn.Close()
+		return
+	}
+	if c.idle == nil {
+		c.idle = make(map[string][]*handshakeConn)
+	}
+	c.idle[key] = append(c.idle[key], conn)
+	c.mu.Unlock()
+}
+
+// keep wraps the body of res so that conn is returned to the cache once it is closed.
+func (c *HandshakeCache) keep(key string, conn *handshakeConn, res *http.Response) *http.Response {
+	res.Body = &releaseOnClose{ReadCloser: res.Body, release: func() { c.put(key, conn) }}
+	return res
+}
+
+func (c *HandshakeCache) countHandshake() {
+	if c != nil {
+		atomic.AddUint64(&c.handshakes, 1)
+	}
+}
+
+func (c *HandshakeCache) countProbeSkipped() {
+	if c != nil {
+		atomic.AddUint64(&c.probesSkipped, 1)
+	}
+}
+
+func (c *HandshakeCache) countConnectionReused() {
+	if c != nil {
+		atomic.AddUint64(&c.connectionsReused, 1)
+	}
+}
+
+// hostKey identifies the connections to the host of u
+func hostKey(u *url.URL) string {
+	return u.Scheme + "://" + u.Host
+}
+
+// connKey identifies the connections to the host of u authenticated with creds
+func connKey(u *url.URL, creds *Credentials) string {
+	h := sha256.New()
+	for _, s := range []string{creds.User, creds.Password, creds.Hash, creds.Domain, creds.Workstation} {
+		io.WriteString(h, s)
+		h.Write([]byte{0})
+	}
+	return hostKey(u) + " " + hex.EncodeToString(h.Sum(nil))
+}
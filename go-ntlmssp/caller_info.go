@@ -5,6 +5,9 @@ import (
 	"runtime"
 )
 
+// CallerInfo returns the file, line and function of its caller.
+//
+// Deprecated: the package logs through log/slog and no longer uses it.
 func CallerInfo() string {
 	pc, file, line, ok := runtime.Caller(1)
 	if !ok {
@@ -4,30 +4,65 @@ import (
 	"crypto/rand"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"time"
 )
 
-// generateClientChallenge generates an 8-byte cryptographically secure random nonce.
+// generateClientChallenge reads an 8-byte nonce from r, crypto/rand.Reader if nil.
 // This is used is the NTLMv2 response to ensure uniqueness and freshness.
-func generateClientChallenge() ([]byte, error) {
+func generateClientChallenge(r io.Reader) ([]byte, error) {
 	challenge := make([]byte, 8)
-	_, err := rand.Read(challenge)
-	if err != nil {
+	if err := readRandom(r, challenge); err != nil {
 		return nil, fmt.Errorf("failed to generate client challenge: %w", err)
 	}
 	return challenge, nil
 }
 
-// generateTimestamp returns the current time in Windows FILETIME format.
+// generateTimestamp returns now in Windows FILETIME format.
 // This is a 64-bit value representing the number of 100-nanosecond intervals since January 1, 1601 (UTC).
-func generateTimestamp() []byte {
+func generateTimestamp(now time.Time) []byte {
 	// Unix epoch in NT time format offset (in 100ns intervals)
 	const windowsToUnixEpochOffset = 116444736000000000
 
-	// Current time in 100ns intervals
-	now := time.Now().UTC().UnixNano()/100 + windowsToUnixEpochOffset
+	// Time in 100ns intervals, without UnixNano which overflows before 1678
+	ft := now.Unix()*10000000 + int64(now.Nanosecond()/100) + windowsToUnixEpochOffset
 
 	timestamp := make([]byte, 8)
-	binary.LittleEndian.PutUint64(timestamp, uint64(now))
+	binary.LittleEndian.PutUint64(timestamp, uint64(ft))
 	return timestamp
 }
+
+// parseTimestamp decodes a Windows FILETIME as encoded by generateTimestamp.
+func parseTimestamp(timestamp []byte) time.Time {
+	const windowsToUnixEpochOffset = 11644473600 // in seconds
+	ft := binary.LittleEndian.Uint64(timestamp)
+	return time.Unix(int64(ft/10000000)-windowsToUnixEpochOffset, int64(ft%10000000)*100).UTC()
+}
+
+// generateExportedSessionKey reads a 16-byte ExportedSessionKey from r, used when
+// the server negotiated NTLMSSP_NEGOTIATE_KEY_EXCH.
+func generateExportedSessionKey(r io.Reader) ([]byte, error) {
+	key := make([]byte, 16)
+	if err := readRandom(r, key); err != nil {
+		return nil, fmt.Errorf("failed to generate exported session key: %w", err)
+	}
+	return key, nil
+}
+
+// generateServerChallenge generates the random 8-byte nonce sent in a CHALLENGE message.
+func generateServerChallenge() ([8]byte, error) {
+	var challenge [8]byte
+	if err := readRandom(nil, challenge[:]); err != nil {
+		return challenge, fmt.Errorf("failed to generate server challenge: %w", err)
+	}
+	return challenge, nil
+}
+
+// readRandom fills b from r, crypto/rand.Reader if nil. A short read is an error.
+func readRandom(r io.Reader, b []byte) error {
+	if r == nil {
+		r = rand.Reader
+	}
+	_, err := io.ReadFull(r, b)
+	return err
+}
@@ -4,13 +4,12 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
-	"log"
 )
 
 type challengeMessageFields struct {
 	messageHeader
 	TargetName      varField
-	NegotiateFlags  negotiateFlags
+	NegotiateFlags  NegotiateFlags
 	ServerChallenge [8]byte
 	_               [8]byte
 	TargetInfo      varField
@@ -20,72 +19,136 @@ func (m challengeMessageFields) IsValid() bool {
 	return m.messageHeader.IsValid() && m.MessageType == 2
 }
 
-type challengeMessage struct {
-	challengeMessageFields
-	TargetName    string
-	TargetInfo    map[avID][]byte
-	TargetInfoRaw []byte
+// ChallengeMessage is a CHALLENGE (Type 2) message, sent by the server in response
+// to a NEGOTIATE message, see https://msdn.microsoft.com/en-us/library/cc236642.aspx
+type ChallengeMessage struct {
+	NegotiateFlags  NegotiateFlags
+	TargetName      string
+	ServerChallenge [8]byte
+
+	// TargetInfo is the raw AV_PAIR list describing the server
+	TargetInfo []byte
+
+	// Version is written as zeros when not set
+	Version *Version
+
+	// CodePage encodes TargetName when NTLMSSP_NEGOTIATE_UNICODE is not set
+	CodePage *CodePage
 }
 
-func (m *challengeMessage) UnmarshalBinary(data []byte) error {
+// MarshalBinary encodes the message. The target name is encoded according
+// to the NTLMSSP_NEGOTIATE_UNICODE flag.
+func (m ChallengeMessage) MarshalBinary() ([]byte, error) {
+	target := toUnicode(m.TargetName)
+	if !m.NegotiateFlags.Has(negotiateFlagNTLMSSPNEGOTIATEUNICODE) {
+		var err error
+		if target, err = m.CodePage.encodeString(m.TargetName); err != nil {
+			return nil, err
+		}
+	}
+
+	var version Version
+	if m.Version != nil {
+		version = *m.Version
+	}
+
+	ptr := binary.Size(&challengeMessageFields{}) + binary.Size(&version)
+	f := challengeMessageFields{
+		messageHeader:   newMessageHeader(2),
+		TargetName:      newVarField(&ptr, len(target)),
+		NegotiateFlags:  m.NegotiateFlags,
+		ServerChallenge: m.ServerChallenge,
+		TargetInfo:      newVarField(&ptr, len(m.TargetInfo)),
+	}
+
+	b := bytes.Buffer{}
+	if err := binary.Write(&b, binary.LittleEndian, &f); err != nil {
+		logger().Debug("error writing f in buffer", "error", err)
+		return nil, err
+	}
+	if err := binary.Write(&b, binary.LittleEndian, &version); err != nil {
+		logger().Debug("error writing version in buffer", "error", err)
+		return nil, err
+	}
+	b.Write(target)
+	b.Write(m.TargetInfo)
+	return b.Bytes(), nil
+}
+
+// UnmarshalBinary decodes a CHALLENGE message, with the code page already set
+// in m. Version is set when the message has room for it and it is not all zeros.
+func (m *ChallengeMessage) UnmarshalBinary(data []byte) error {
+	var f challengeMessageFields
 	r := bytes.NewReader(data)
-	err := binary.Read(r, binary.LittleEndian, &m.challengeMessageFields)
+	err := binary.Read(r, binary.LittleEndian, &f)
 	if err != nil {
-		log.Printf("[DEBUG]%s error reading challenge message field: %s", CallerInfo(), err.Error())
-		return err
+		logger().Debug("error reading challenge message field", "error", err)
+		return fmt.Errorf("%w: %w", ErrInvalidMessage, err)
 	}
-	if !m.challengeMessageFields.IsValid() {
-		log.Printf("[DEBUG]%s message is not a valid challenge message: %+v", CallerInfo(), m.challengeMessageFields.messageHeader)
-		return fmt.Errorf("message is not a valid challenge message: %+v", m.challengeMessageFields.messageHeader)
+	if !f.IsValid() {
+		logger().Debug("message is not a valid challenge message", "signature", string(f.Signature[:]), "type", f.MessageType)
+		return fmt.Errorf("%w: not a challenge message (type %d)", ErrInvalidMessage, f.MessageType)
 	}
 
-	if m.challengeMessageFields.TargetName.Len > 0 {
-		m.TargetName, err = m.challengeMessageFields.TargetName.ReadStringFrom(data, m.NegotiateFlags.Has(negotiateFlagNTLMSSPNEGOTIATEUNICODE))
-		if err != nil {
-			log.Printf("[DEBUG]%s error reading negotiate flag: %s", CallerInfo(), err.Error())
+	*m = ChallengeMessage{
+		NegotiateFlags:  f.NegotiateFlags,
+		ServerChallenge: f.ServerChallenge,
+		CodePage:        m.CodePage,
+	}
+
+	if payloadOffset(data, f.TargetName, f.TargetInfo) >= uint32(binary.Size(&f)+binary.Size(Version{})) {
+		if m.Version, err = readVersion(r); err != nil {
 			return err
 		}
 	}
 
-	if m.challengeMessageFields.TargetInfo.Len > 0 {
-		d, err := m.challengeMessageFields.TargetInfo.ReadFrom(data)
-		m.TargetInfoRaw = d
+	if f.TargetName.Len > 0 {
+		m.TargetName, err = f.TargetName.ReadStringFrom(data, m.NegotiateFlags.Has(negotiateFlagNTLMSSPNEGOTIATEUNICODE), m.CodePage)
 		if err != nil {
-			log.Printf("[DEBUG]%s error reading target info: %s", CallerInfo(), err.Error())
+			logger().Debug("error reading negotiate flag", "error", err)
 			return err
 		}
-		m.TargetInfo = make(map[avID][]byte)
-		r := bytes.NewReader(d)
-		for {
-			var id avID
-			var l uint16
-			err = binary.Read(r, binary.LittleEndian, &id)
-			if err != nil {
-				log.Printf("[DEBUG]%s error reading id: %s", CallerInfo(), err.Error())
-				return err
-			}
-			if id == avIDMsvAvEOL {
-				break
-			}
-
-			err = binary.Read(r, binary.LittleEndian, &l)
-			if err != nil {
-				log.Printf("[DEBUG]%s error reading l: %s", CallerInfo(), err.Error())
-				return err
-			}
-			value := make([]byte, l)
-			n, err := r.Read(value)
-			if err != nil {
-				log.Printf("[DEBUG]%s error reading binary l: %s", CallerInfo(), err.Error())
-				return err
-			}
-			if n != int(l) {
-				log.Printf("[DEBUG]%s expected to read %d bytes, got only %d", CallerInfo(), l, n)
-				return fmt.Errorf("expected to read %d bytes, got only %d", l, n)
-			}
-			m.TargetInfo[id] = value
+	}
+
+	if f.TargetInfo.Len > 0 {
+		m.TargetInfo, err = f.TargetInfo.ReadFrom(data)
+		if err != nil {
+			logger().Debug("error reading target info", "error", err)
+			return err
 		}
 	}
 
 	return nil
 }
+
+// challengeFlags returns the flags of a CHALLENGE message without parsing it,
+// zero if it is too short.
+func challengeFlags(data []byte) NegotiateFlags {
+	if len(data) < 24 {
+		return 0
+	}
+	return NegotiateFlags(binary.LittleEndian.Uint32(data[20:24]))
+}
+
+// challengeMessage is a parsed CHALLENGE message with its target info
+// split into AV pairs.
+type challengeMessage struct {
+	ChallengeMessage
+	TargetInfoPairs AVPairs
+}
+
+func (m *challengeMessage) UnmarshalBinary(data []byte) error {
+	if err := m.ChallengeMessage.UnmarshalBinary(data); err != nil {
+		return err
+	}
+	m.TargetInfoPairs = nil
+	if m.TargetInfo != nil {
+		if err := m.TargetInfoPairs.UnmarshalBinary(m.TargetInfo); err != nil {
+			return err
+		}
+		if err := m.TargetInfoPairs.check(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package ntlmssp
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/md5"
+	"crypto/x509"
+	"encoding/binary"
+
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+)
+
+// ChannelBindings is a struct representing the gss_channel_bindings_struct from
+// RFC 2744, used for Extended Protection for Authentication (EPA).
+type ChannelBindings struct {
+	InitiatorAddrType uint32
+	InitiatorAddress  []byte
+	AcceptorAddrType  uint32
+	AcceptorAddress   []byte
+	ApplicationData   []byte
+}
+
+// TLSServerEndPointBindings returns the tls-server-end-point channel bindings (RFC 5929)
+// for the certificate presented by the server.
+func TLSServerEndPointBindings(cert *x509.Certificate) *ChannelBindings {
+	var hash crypto.Hash
+	switch cert.SignatureAlgorithm {
+	case x509.SHA384WithRSA, x509.SHA384WithRSAPSS, x509.ECDSAWithSHA384:
+		hash = crypto.SHA384
+	case x509.SHA512WithRSA, x509.SHA512WithRSAPSS, x509.ECDSAWithSHA512:
+		hash = crypto.SHA512
+	default: // MD5 and SHA-1 are upgraded to SHA-256 as well
+		hash = crypto.SHA256
+	}
+	h := hash.New()
+	h.Write(cert.Raw)
+
+	return &ChannelBindings{
+		ApplicationData: append([]byte("tls-server-end-point:"), h.Sum(nil)...),
+	}
+}
+
+// MarshalBinary flattens the channel bindings the way they are hashed into the
+// MsvAvChannelBindings AV pair.
+func (cb ChannelBindings) MarshalBinary() ([]byte, error) {
+	b := bytes.Buffer{}
+	fields := []interface{}{
+		cb.InitiatorAddrType, uint32(len(cb.InitiatorAddress)), cb.InitiatorAddress,
+		cb.AcceptorAddrType, uint32(len(cb.AcceptorAddress)), cb.AcceptorAddress,
+		uint32(len(cb.ApplicationData)), cb.ApplicationData,
+	}
+	for _, f := range fields {
+		if err := binary.Write(&b, binary.LittleEndian, f); err != nil {
+			logger().Debug("error writing channel bindings in buffer", "error", err)
+			return nil, err
+		}
+	}
+	return b.Bytes(), nil
+}
+
+// hash returns the MD5 hash of the channel bindings, the value of the
+// MsvAvChannelBindings AV pair.
+func (cb ChannelBindings) hash() ([]byte, error) {
+	d, err := cb.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	h := md5.Sum(d)
+	return h[:], nil
+}
@@ -0,0 +1,109 @@
+package ntlmssp
+
+import (
+	"fmt"
+	"strings"
+)
+
+// CodePage is an OEM code page, encoding the strings of NTLM messages when
+// NTLMSSP_NEGOTIATE_UNICODE is not negotiated. A nil *CodePage is CodePage437.
+type CodePage struct {
+	name string
+
+	// high are the characters of bytes 0x80 to 0xff, the lower half is ASCII
+	high   [128]rune
+	encode map[rune]byte
+}
+
+// OEM code pages of Windows, CodePage437 is the one of US English systems and
+// CodePage850 the one of western European systems. CodePage1252 is the ANSI
+// code page some embedded servers use instead.
+var (
+	CodePage437  = newCodePage("cp437", cp437)
+	CodePage850  = newCodePage("cp850", cp850)
+	CodePage1252 = newCodePage("cp1252", cp1252)
+)
+
+func newCodePage(name, high string) *CodePage {
+	c := &CodePage{name: name, encode: make(map[rune]byte, 128)}
+	for i, r := range []rune(high) {
+		c.high[i] = r
+		c.encode[r] = byte(0x80 + i)
+	}
+	return c
+}
+
+func (c *CodePage) String() string {
+	return c.or().name
+}
+
+func (c *CodePage) or() *CodePage {
+	if c == nil {
+		return CodePage437
+	}
+	return c
+}
+
+// encodeString encodes s, failing on characters missing from the code page.
+func (c *CodePage) encodeString(s string) ([]byte, error) {
+	c = c.or()
+	b := make([]byte, 0, len(s))
+	for _, r := range s {
+		if r < 0x80 {
+			b = append(b, byte(r))
+			continue
+		}
+		v, ok := c.encode[r]
+		if !ok {
+			logger().Debug("character not in oem code page", "codepage", c.name)
+			return nil, fmt.Errorf("%w: %q not in %s", ErrNotEncodable, r, c.name)
+		}
+		b = append(b, v)
+	}
+	return b, nil
+}
+
+// decodeString decodes b, every byte is a character of the code page.
+func (c *CodePage) decodeString(b []byte) string {
+	c = c.or()
+	s := strings.Builder{}
+	for _, v := range b {
+		if v < 0x80 {
+			s.WriteByte(v)
+		} else {
+			s.WriteRune(c.high[v-0x80])
+		}
+	}
+	return s.String()
+}
+
+const cp437 = "" +
+	"\u00c7\u00fc\u00e9\u00e2\u00e4\u00e0\u00e5\u00e7\u00ea\u00eb\u00e8\u00ef\u00ee\u00ec\u00c4\u00c5" + // 80
+	"\u00c9\u00e6\u00c6\u00f4\u00f6\u00f2\u00fb\u00f9\u00ff\u00d6\u00dc\u00a2\u00a3\u00a5\u20a7\u0192" + // 90
+	"\u00e1\u00ed\u00f3\u00fa\u00f1\u00d1\u00aa\u00ba\u00bf\u2310\u00ac\u00bd\u00bc\u00a1\u00ab\u00bb" + // a0
+	"\u2591\u2592\u2593\u2502\u2524\u2561\u2562\u2556\u2555\u2563\u2551\u2557\u255d\u255c\u255b\u2510" + // b0
+	"\u2514\u2534\u252c\u251c\u2500\u253c\u255e\u255f\u255a\u2554\u2569\u2566\u2560\u2550\u256c\u2567" + // c0
+	"\u2568\u2564\u2565\u2559\u2558\u2552\u2553\u256b\u256a\u2518\u250c\u2588\u2584\u258c\u2590\u2580" + // d0
+	"\u03b1\u00df\u0393\u03c0\u03a3\u03c3\u00b5\u03c4\u03a6\u0398\u03a9\u03b4\u221e\u03c6\u03b5\u2229" + // e0
+	"\u2261\u00b1\u2265\u2264\u2320\u2321\u00f7\u2248\u00b0\u2219\u00b7\u221a\u207f\u00b2\u25a0\u00a0" //  f0
+
+const cp850 = "" +
+	"\u00c7\u00fc\u00e9\u00e2\u00e4\u00e0\u00e5\u00e7\u00ea\u00eb\u00e8\u00ef\u00ee\u00ec\u00c4\u00c5" + // 80
+	"\u00c9\u00e6\u00c6\u00f4\u00f6\u00f2\u00fb\u00f9\u00ff\u00d6\u00dc\u00f8\u00a3\u00d8\u00d7\u0192" + // 90
+	"\u00e1\u00ed\u00f3\u00fa\u00f1\u00d1\u00aa\u00ba\u00bf\u00ae\u00ac\u00bd\u00bc\u00a1\u00ab\u00bb" + // a0
+	"\u2591\u2592\u2593\u2502\u2524\u00c1\u00c2\u00c0\u00a9\u2563\u2551\u2557\u255d\u00a2\u00a5\u2510" + // b0
+	"\u2514\u2534\u252c\u251c\u2500\u253c\u00e3\u00c3\u255a\u2554\u2569\u2566\u2560\u2550\u256c\u00a4" + // c0
+	"\u00f0\u00d0\u00ca\u00cb\u00c8\u0131\u00cd\u00ce\u00cf\u2518\u250c\u2588\u2584\u00a6\u00cc\u2580" + // d0
+	"\u00d3\u00df\u00d4\u00d2\u00f5\u00d5\u00b5\u00fe\u00de\u00da\u00db\u00d9\u00fd\u00dd\u00af\u00b4" + // e0
+	"\u00ad\u00b1\u2017\u00be\u00b6\u00a7\u00f7\u00b8\u00b0\u00a8\u00b7\u00b9\u00b3\u00b2\u25a0\u00a0" //  f0
+
+// the bytes unassigned in cp1252 map to the C1 controls, as on Windows
+const cp1252 = "" +
+	"\u20ac\u0081\u201a\u0192\u201e\u2026\u2020\u2021\u02c6\u2030\u0160\u2039\u0152\u008d\u017d\u008f" + // 80
+	"\u0090\u2018\u2019\u201c\u201d\u2022\u2013\u2014\u02dc\u2122\u0161\u203a\u0153\u009d\u017e\u0178" + // 90
+	"\u00a0\u00a1\u00a2\u00a3\u00a4\u00a5\u00a6\u00a7\u00a8\u00a9\u00aa\u00ab\u00ac\u00ad\u00ae\u00af" + // a0
+	"\u00b0\u00b1\u00b2\u00b3\u00b4\u00b5\u00b6\u00b7\u00b8\u00b9\u00ba\u00bb\u00bc\u00bd\u00be\u00bf" + // b0
+	"\u00c0\u00c1\u00c2\u00c3\u00c4\u00c5\u00c6\u00c7\u00c8\u00c9\u00ca\u00cb\u00cc\u00cd\u00ce\u00cf" + // c0
+	"\u00d0\u00d1\u00d2\u00d3\u00d4\u00d5\u00d6\u00d7\u00d8\u00d9\u00da\u00db\u00dc\u00dd\u00de\u00df" + // d0
+	"\u00e0\u00e1\u00e2\u00e3\u00e4\u00e5\u00e6\u00e7\u00e8\u00e9\u00ea\u00eb\u00ec\u00ed\u00ee\u00ef" + // e0
+	"\u00f0\u00f1\u00f2\u00f3\u00f4\u00f5\u00f6\u00f7\u00f8\u00f9\u00fa\u00fb\u00fc\u00fd\u00fe\u00ff" //  f0
@@ -0,0 +1,105 @@
+package ntlmssp
+
+import (
+	"crypto/tls"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+)
+
+// handshakeConn is the round tripper used for the legs of a handshake. NTLM
+// authenticates connections, so when the round tripper of the Negotiator is a
+// *http.Transport it is cloned into a transport that keeps a single HTTP/1.1
+// connection to each host, making sure all legs are sent on the same connection.
+type handshakeConn struct {
+	http.RoundTripper
+
+	// pinned is set when RoundTripper holds a single connection
+	pinned bool
+}
+
+func newHandshakeConn(rt http.RoundTripper) *handshakeConn {
+	t, ok := rt.(*http.Transport)
+	if !ok {
+		// not ours to pin, connTracker will report connection switches
+		return &handshakeConn{RoundTripper: rt}
+	}
+	t = t.Clone()
+	t.ForceAttemptHTTP2 = false
+	t.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	t.MaxConnsPerHost = 1
+	if t.TLSClientConfig != nil {
+		// do not offer h2 in ALPN, the server would pick it
+		var protos []string
+		for _, p := range t.TLSClientConfig.NextProtos {
+			if p != "h2" {
+				protos = append(protos, p)
+			}
+		}
+		t.TLSClientConfig.NextProtos = protos
+	}
+	return &handshakeConn{RoundTripper: t, pinned: true}
+}
+
+// Close closes the connection if it was pinned. It accepts a nil connection.
+func (c *handshakeConn) Close() {
+	if c != nil && c.pinned {
+		c.RoundTripper.(*http.Transport).CloseIdleConnections()
+	}
+}
+
+// connTracker records the connection used by each leg of a handshake.
+type connTracker struct {
+	mu       sync.Mutex
+	conn     net.Conn
+	switched bool
+	logger   *slog.Logger
+}
+
+// withTrace returns a shallow copy of req reporting its connection to the tracker.
+func (c *connTracker) withTrace(req *http.Request) *http.Request {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			if c.conn == nil {
+				c.conn = info.Conn
+			} else if c.conn != info.Conn {
+				c.switched = true
+			}
+		},
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
+
+// check returns an error if res was not received on the connection of the
+// previous legs, or over a protocol that cannot carry a handshake.
+func (c *connTracker) check(res *http.Response) error {
+	if res.ProtoMajor >= 2 {
+		c.logger.Debug("ntlm authentication attempted over http/2", "proto", res.Proto)
+		return ErrHTTP2
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.switched {
+		c.logger.Debug("connection switched during handshake")
+		return ErrConnectionSwitched
+	}
+	return nil
+}
+
+// releaseOnClose calls release once body is closed
+type releaseOnClose struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releaseOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
@@ -0,0 +1,98 @@
+package ntlmssp
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors returned by the package. They may be wrapped, with details or in a
+// HandshakeError, use errors.Is to check for them.
+var (
+	// ErrInvalidMessage reports a malformed NTLM message
+	ErrInvalidMessage = errors.New("invalid ntlm message")
+
+	ErrUnicodeRequired       = errors.New("only unicode is supported")
+	ErrNotEncodable          = errors.New("string cannot be encoded in the oem code page")
+	ErrNoEncodingNegotiated  = errors.New("neither unicode nor oem encoding negotiated")
+	ErrAnonymousNotSupported = errors.New("anonymous authentication not enabled")
+	ErrNTLMv1NotSupported    = errors.New("only ntlm v2 is supported")
+	ErrInvalidHash           = errors.New("invalid ntlm hash, expected 32 hex digits")
+	ErrDomainRequired        = errors.New("domain is required for ntlmv2 when domainNeeded is true")
+	ErrInvalidBasicAuth      = errors.New("invalid basic authentication header, expected user:password")
+
+	// ErrInvalidCredentials is returned by a Server for a wrong password
+	ErrInvalidCredentials  = errors.New("invalid credentials")
+	ErrInvalidMIC          = errors.New("invalid mic")
+	ErrMissingSessionKey   = errors.New("key exchange negotiated, but no session key sent")
+	ErrNoCredentialStore   = errors.New("no credential store configured")
+	ErrHandshakeIncomplete = errors.New("handshake not completed")
+	// ErrClockSkew is returned by a Server for a response timestamped too far
+	// from its clock, likely replayed
+	ErrClockSkew = errors.New("ntlm v2 response timestamp outside the allowed clock skew")
+
+	// ErrNotNegotiated reports the use of a feature the handshake did not negotiate
+	ErrNotNegotiated      = errors.New("feature was not negotiated")
+	ErrSignatureMismatch  = errors.New("message signature mismatch")
+	ErrConnectionSwitched = errors.New("connection switched during ntlm handshake, the server will not accept the authentication")
+	ErrHTTP2              = errors.New("ntlm authentication is not possible over http/2")
+	ErrBodyNotReplayable  = errors.New("request body was already sent and cannot be sent again, set GetBody on the request")
+	ErrProxyRefused       = errors.New("proxy refused to connect")
+
+	// ErrNoMechanism reports that no security mechanism could start a context
+	ErrNoMechanism = errors.New("no security mechanism available")
+)
+
+// HandshakeStage names a step of the handshake.
+type HandshakeStage string
+
+// Stages of the handshake, as seen by the client
+const (
+	// StageNegotiate is the creation and sending of the NEGOTIATE message
+	StageNegotiate HandshakeStage = "negotiate"
+	// StageChallenge is the reception and parsing of the CHALLENGE message
+	StageChallenge HandshakeStage = "challenge"
+	// StageAuthenticate is the creation and sending of the AUTHENTICATE message
+	StageAuthenticate HandshakeStage = "authenticate"
+)
+
+// HandshakeError reports the failure of a handshake step.
+type HandshakeError struct {
+	Stage HandshakeStage
+
+	// Flags are the flags advertised by the server in its CHALLENGE message,
+	// zero if it was not received or could not be parsed
+	Flags NegotiateFlags
+
+	// StatusCode is the HTTP status of the last response, zero outside of HTTP
+	StatusCode int
+
+	Err error
+}
+
+func (e *HandshakeError) Error() string {
+	msg := fmt.Sprintf("ntlm %s failed", e.Stage)
+	if e.StatusCode != 0 {
+		msg += fmt.Sprintf(" (http status %d)", e.StatusCode)
+	}
+	return msg + ": " + e.Err.Error()
+}
+
+func (e *HandshakeError) Unwrap() error {
+	return e.Err
+}
+
+// handshakeError wraps err in a HandshakeError. If err already is one, its
+// unset fields are completed instead.
+func handshakeError(stage HandshakeStage, flags NegotiateFlags, statusCode int, err error) error {
+	var he *HandshakeError
+	if errors.As(err, &he) {
+		if he.Flags == 0 {
+			he.Flags = flags
+		}
+		if he.StatusCode == 0 {
+			he.StatusCode = statusCode
+		}
+		return err
+	}
+	return &HandshakeError{Stage: stage, Flags: flags, StatusCode: statusCode, Err: err}
+}
@@ -0,0 +1,219 @@
+package ntlmssp
+
+import (
+	"bytes"
+	"encoding/asn1"
+	"encoding/base64"
+	"testing"
+)
+
+// Fuzz targets for the parsers of messages sent by the peer, which must
+// reject malformed input without panicking. Their seeds, with the corpus of
+// testdata/fuzz, run with the tests. Fuzz one with, for instance:
+//
+//	go test -fuzz=FuzzChallengeMessage
+
+// fuzzChallengeMessages are valid CHALLENGE messages seeding the corpus
+func fuzzChallengeMessages(f *testing.F) [][]byte {
+	f.Helper()
+	timestamp := []byte{0x00, 0x90, 0xd3, 0x36, 0xb7, 0x34, 0xc3, 0x01}
+	var messages [][]byte
+	for _, cm := range []ChallengeMessage{
+		{NegotiateFlags: defaultFlags, TargetName: target, ServerChallenge: nlmpServerChallenge},
+		{NegotiateFlags: 0xe28a8233, TargetName: nlmpServerName, ServerChallenge: nlmpServerChallenge,
+			TargetInfo: nlmpTargetInfo, Version: &nlmpServerVersion},
+		{NegotiateFlags: defaultFlags | negotiateFlagNTLMSSPNEGOTIATEKEYEXCH, TargetName: target, ServerChallenge: nlmpServerChallenge,
+			TargetInfo: marshalAVPairs(AVPairs{
+				{MsvAvNbDomainName, toUnicode(target)},
+				{MsvAvFlags, []byte{0x02, 0x00, 0x00, 0x00}},
+				{MsvAvTimestamp, timestamp},
+			})},
+		{NegotiateFlags: negotiateFlagNTLMNEGOTIATEOEM | negotiateFlagNTLMSSPNEGOTIATELMKEY, TargetName: target, ServerChallenge: nlmpServerChallenge},
+	} {
+		b, err := cm.MarshalBinary()
+		if err != nil {
+			f.Fatalf("error creating challenge message: %s", err)
+		}
+		messages = append(messages, b)
+	}
+	return messages
+}
+
+func FuzzChallengeMessage(f *testing.F) {
+	for _, b := range fuzzChallengeMessages(f) {
+		f.Add(b)
+	}
+	f.Add([]byte("NTLMSSP\x00\x02\x00\x00\x00"))
+	// target info at an offset and with a length overflowing 32 bits
+	f.Add(append([]byte("NTLMSSP\x00\x02\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x02\x00\x00"+
+		"\x01\x23\x45\x67\x89\xab\xcd\xef\x00\x00\x00\x00\x00\x00\x00\x00"), 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff))
+
+	nm, err := NewNegotiateMessage(domain, workstation)
+	if err != nil {
+		f.Fatalf("error creating negotiate message: %s", err)
+	}
+	cb := &ChannelBindings{ApplicationData: []byte("tls-server-end-point:0123456789abcdef")}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var cm challengeMessage
+		if err := cm.UnmarshalBinary(data); err != nil {
+			return
+		}
+		for _, opts := range []ChallengeOptions{
+			{NegotiateMessage: nm, ChannelBindings: cb},
+			{InsecureNTLMv1: true},
+			{Anonymous: true},
+		} {
+			ProcessChallengeWithOptions(data, username, password, true, opts)
+		}
+		GenerateType3(data, username, password, domain, true)
+	})
+}
+
+func FuzzNegotiateMessage(f *testing.F) {
+	for _, session := range []bool{false, true} {
+		newNegotiateMessage := NewNegotiateMessage
+		if session {
+			newNegotiateMessage = NewSessionNegotiateMessage
+		}
+		nm, err := newNegotiateMessage(domain, workstation)
+		if err != nil {
+			f.Fatalf("error creating negotiate message: %s", err)
+		}
+		f.Add(nm)
+	}
+	f.Add([]byte("NTLMSSP\x00\x01\x00\x00\x00"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var m, again NegotiateMessage
+		if err := m.UnmarshalBinary(data); err != nil {
+			return
+		}
+		b, err := m.MarshalBinary()
+		if err != nil {
+			return
+		}
+		if err := again.UnmarshalBinary(b); err != nil {
+			t.Fatalf("error parsing marshaled message: %s", err)
+		}
+	})
+}
+
+func FuzzAuthenticateMessage(f *testing.F) {
+	for _, b := range fuzzChallengeMessages(f) {
+		nm, err := NewNegotiateMessage(domain, workstation)
+		if err != nil {
+			f.Fatalf("error creating negotiate message: %s", err)
+		}
+		am, _, err := ProcessChallengeWithOptions(b, username, password, true, ChallengeOptions{NegotiateMessage: nm, InsecureNTLMv1: true})
+		if err != nil {
+			f.Fatalf("error processing challenge message: %s", err)
+		}
+		f.Add(am)
+	}
+	f.Add([]byte("NTLMSSP\x00\x03\x00\x00\x00"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var m, again AuthenticateMessage
+		if err := m.UnmarshalBinary(data); err != nil {
+			return
+		}
+		b, err := m.MarshalBinary()
+		if err != nil {
+			return
+		}
+		if err := again.UnmarshalBinary(b); err != nil {
+			t.Fatalf("error parsing marshaled message: %s", err)
+		}
+	})
+}
+
+func FuzzAVPairs(f *testing.F) {
+	f.Add(nlmpTargetInfo)
+	f.Add([]byte{})
+	f.Add([]byte{0x07, 0x00, 0xff, 0xff})
+	f.Add(marshalAVPairs(AVPairs{{MsvAvFlags, []byte{1}}, {MsvAvFlags, []byte{2}}}))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var pairs, again AVPairs
+		if err := pairs.UnmarshalBinary(data); err != nil {
+			return
+		}
+		pairs.check()
+		b, err := pairs.MarshalBinary()
+		if err != nil {
+			t.Fatalf("error marshaling pairs: %s", err)
+		}
+		if err := again.UnmarshalBinary(b); err != nil {
+			t.Fatalf("error parsing marshaled pairs: %s", err)
+		}
+		if len(again) != len(pairs) {
+			t.Fatalf("expected %d pairs, got %d", len(pairs), len(again))
+		}
+		for i := range pairs {
+			if again[i].ID != pairs[i].ID || !bytes.Equal(again[i].Value, pairs[i].Value) {
+				t.Fatalf("expected pair %v, got %v", pairs[i], again[i])
+			}
+		}
+	})
+}
+
+func FuzzServerContext(f *testing.F) {
+	nm, err := NewSessionNegotiateMessage(domain, workstation)
+	if err != nil {
+		f.Fatalf("error creating negotiate message: %s", err)
+	}
+	c := newTestServer().NewContext()
+	cm, err := c.ProcessNegotiate(nm)
+	if err != nil {
+		f.Fatalf("error processing negotiate message: %s", err)
+	}
+	am, err := ProcessChallenge(cm, username, password, true)
+	if err != nil {
+		f.Fatalf("error processing challenge message: %s", err)
+	}
+	f.Add(nm, am)
+	f.Add(nm, []byte("NTLMSSP\x00\x03\x00\x00\x00"))
+	f.Add([]byte("NTLMSSP\x00\x01\x00\x00\x00\xff\xff\xff\xff"), am)
+
+	server := newTestServer()
+	server.AllowAnonymous = true
+	f.Fuzz(func(t *testing.T, negotiateMessage, authenticateMessage []byte) {
+		c := server.NewContext()
+		if _, err := c.ProcessNegotiate(negotiateMessage); err != nil {
+			return
+		}
+		if _, err := c.ProcessAuthenticate(authenticateMessage); err != nil {
+			return
+		}
+		c.Session()
+	})
+}
+
+func FuzzSPNEGO(f *testing.F) {
+	init, err := NegTokenInit{MechTypes: []asn1.ObjectIdentifier{MechTypeNTLMSSP}, MechToken: []byte("NTLMSSP\x00")}.MarshalBinary()
+	if err != nil {
+		f.Fatalf("error creating NegTokenInit: %s", err)
+	}
+	state := NegStateAcceptIncomplete
+	resp, err := NegTokenResp{NegState: &state, SupportedMech: MechTypeNTLMSSP, ResponseToken: []byte("NTLMSSP\x00")}.MarshalBinary()
+	if err != nil {
+		f.Fatalf("error creating NegTokenResp: %s", err)
+	}
+	f.Add(init)
+	f.Add(resp)
+	f.Add([]byte{0x60, 0x80})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		unwrapSPNEGO(data)
+		var resp NegTokenResp
+		resp.UnmarshalBinary(data)
+	})
+}
+
+func FuzzAuthheader(f *testing.F) {
+	f.Add("Basic " + base64.StdEncoding.EncodeToString([]byte("user:password")))
+	f.Add("Basic " + base64.StdEncoding.EncodeToString([]byte("user")))
+	f.Add("NTLM TlRMTVNTUAABAAAA")
+	f.Add("Negotiate")
+	f.Fuzz(func(t *testing.T, header string) {
+		h := authheader{header}
+		h.GetData()
+		h.GetBasicCreds()
+	})
+}
@@ -0,0 +1,274 @@
+package ntlmssp
+
+import (
+	"encoding/asn1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+)
+
+// authScheme names the status code and headers of an authentication exchange,
+// either with the server or with a proxy.
+type authScheme struct {
+	status              int
+	challengeHeader     string
+	authorizationHeader string
+}
+
+var (
+	serverAuthScheme = authScheme{http.StatusUnauthorized, "Www-Authenticate", "Authorization"}
+	proxyAuthScheme  = authScheme{http.StatusProxyAuthRequired, "Proxy-Authenticate", "Proxy-Authorization"}
+)
+
+// stage names the handshake in log records
+func (s authScheme) stage() string {
+	if s == proxyAuthScheme {
+		return "proxy"
+	}
+	return "server"
+}
+
+// challenged reports whether res asks for NTLM or Negotiate authentication.
+func (s authScheme) challenged(res *http.Response) bool {
+	resauth := authheader(res.Header.Values(s.challengeHeader))
+	return res.StatusCode == s.status && (resauth.IsNegotiate() || resauth.IsNTLM())
+}
+
+// setAuthorization sets the authorization header carrying message, using the
+// mechanism name the peer offered in resauth.
+func (s authScheme) setAuthorization(h http.Header, resauth authheader, message []byte) {
+	if resauth.IsNTLM() {
+		h.Set(s.authorizationHeader, "NTLM "+base64.StdEncoding.EncodeToString(message))
+	} else {
+		h.Set(s.authorizationHeader, "Negotiate "+base64.StdEncoding.EncodeToString(message))
+	}
+}
+
+// clientHandshake is the client side of a single handshake using Credentials.
+// With the Negotiate scheme, the tokens of the mechanisms are wrapped in
+// SPNEGO tokens, otherwise the NTLM mechanism is used as is.
+type clientHandshake struct {
+	mechs  []Mechanism
+	target string
+	creds  *Credentials
+	logger *slog.Logger
+
+	spnego bool
+
+	// mechTypes is the DER list of the mechanisms offered, for the mechListMIC
+	mechTypes []byte
+	offered   []Mechanism
+
+	mech     Mechanism
+	ctx      SecContext
+	complete bool
+}
+
+// newClientHandshake starts a handshake with the server or proxy named
+// target, using mechs in order of preference, or NTLM if empty.
+func newClientHandshake(mechs []Mechanism, target string, creds *Credentials, logger *slog.Logger) *clientHandshake {
+	if len(mechs) == 0 {
+		mechs = defaultMechanisms
+	}
+	return &clientHandshake{mechs: mechs, target: target, creds: creds, logger: logger}
+}
+
+// start starts a security context with mech.
+func (h *clientHandshake) start(mech Mechanism) error {
+	var ctx SecContext
+	var err error
+	if m, ok := mech.(loggingMechanism); ok {
+		ctx, err = m.newSecContext(h.target, h.creds, h.spnego, h.logger)
+	} else {
+		ctx, err = mech.NewSecContext(h.target, h.creds, h.spnego)
+	}
+	if err != nil {
+		h.logger.Debug("error starting security context", "mech", mech.OID().String(), "error", err)
+		return err
+	}
+	h.mech, h.ctx, h.complete = mech, ctx, false
+	return nil
+}
+
+// step passes the token of the peer to the security context.
+func (h *clientHandshake) step(input []byte, bindings *ChannelBindings) ([]byte, error) {
+	output, complete, err := h.ctx.InitSecContext(input, bindings)
+	if err != nil {
+		return nil, err
+	}
+	h.complete = complete
+	return output, nil
+}
+
+// negotiateToken returns the first token. It is wrapped in a SPNEGO
+// NegTokenInit offering all the mechanisms that can start a context, unless
+// the peer offered NTLM in resauth.
+func (h *clientHandshake) negotiateToken(resauth authheader) ([]byte, error) {
+	h.spnego = !resauth.IsNTLM()
+	if !h.spnego {
+		for _, mech := range h.mechs {
+			if mech.OID().Equal(MechTypeNTLMSSP) {
+				if err := h.start(mech); err != nil {
+					return nil, err
+				}
+				return h.step(nil, nil)
+			}
+		}
+		h.logger.Debug("ntlm requested, but not among the mechanisms")
+		return nil, fmt.Errorf("%w: ntlm requested", ErrNoMechanism)
+	}
+
+	// the first mechanism that starts sends its token optimistically, the
+	// ones that fail before it are not offered
+	var token []byte
+	var lastErr error
+	for _, mech := range h.mechs {
+		if h.ctx != nil {
+			h.offered = append(h.offered, mech)
+			continue
+		}
+		if lastErr = h.start(mech); lastErr != nil {
+			continue
+		}
+		if token, lastErr = h.step(nil, nil); lastErr != nil {
+			h.logger.Debug("error creating first token, trying next mechanism", "mech", mech.OID().String(), "error", lastErr)
+			h.ctx = nil
+			continue
+		}
+		h.offered = append(h.offered, mech)
+	}
+	if h.ctx == nil {
+		return nil, fmt.Errorf("%w: %w", ErrNoMechanism, lastErr)
+	}
+	init := NegTokenInit{MechToken: token}
+	for _, mech := range h.offered {
+		init.MechTypes = append(init.MechTypes, mech.OID())
+	}
+	var err error
+	if h.mechTypes, err = asn1.Marshal(init.MechTypes); err != nil {
+		return nil, err
+	}
+	return init.MarshalBinary()
+}
+
+// nextToken answers the token of the peer, it is only called while the
+// peer still asks for authentication.
+func (h *clientHandshake) nextToken(token []byte, bindings *ChannelBindings) ([]byte, error) {
+	if !h.spnego {
+		return h.step(token, bindings)
+	}
+	if isNTLMMessage(token) && h.mech.OID().Equal(MechTypeNTLMSSP) {
+		// some servers answer Negotiate with raw NTLM messages
+		h.logger.Debug("raw ntlm token in negotiate scheme")
+		h.spnego = false
+		return h.step(token, bindings)
+	}
+	var resp NegTokenResp
+	if err := resp.UnmarshalBinary(token); err != nil {
+		h.logger.Debug("error parsing negTokenResp", "error", err)
+		return nil, err
+	}
+	if resp.NegState != nil && *resp.NegState == NegStateReject {
+		h.logger.Debug("negotiation rejected")
+		return nil, fmt.Errorf("%w: negotiation rejected", ErrInvalidCredentials)
+	}
+	if resp.SupportedMech != nil && !mechEqual(h.mech, resp.SupportedMech) {
+		if err := h.selectMech(resp.SupportedMech, resp.ResponseToken); err != nil {
+			return nil, err
+		}
+	}
+
+	output, err := h.step(resp.ResponseToken, bindings)
+	if err != nil {
+		return nil, err
+	}
+	next := NegTokenResp{ResponseToken: output}
+	if h.complete {
+		next.MechListMIC, err = h.ctx.GetMIC(h.mechTypes)
+		if errors.Is(err, ErrNotNegotiated) {
+			h.logger.Debug("mechanism cannot sign, no mechListMIC", "mech", h.mech.OID().String())
+			err = nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return next.MarshalBinary()
+}
+
+// selectMech switches to the mechanism the peer selected instead of the
+// optimistic one.
+func (h *clientHandshake) selectMech(oid asn1.ObjectIdentifier, token []byte) error {
+	for _, mech := range h.offered {
+		if !mechEqual(mech, oid) {
+			continue
+		}
+		if token != nil {
+			h.logger.Debug("token for a mechanism not started", "mech", oid.String())
+			return fmt.Errorf("%w: token for mechanism %s not started", ErrInvalidMessage, oid)
+		}
+		h.logger.Debug("peer selected another mechanism", "mech", oid.String())
+		return h.start(mech)
+	}
+	h.logger.Debug("unsupported mechanism selected", "mech", oid.String())
+	return fmt.Errorf("%w: mechanism %s selected, but not offered", ErrInvalidMessage, oid)
+}
+
+// flags returns the flags of the NTLM CHALLENGE message, for errors.
+func (h *clientHandshake) flags() NegotiateFlags {
+	if c, ok := h.ctx.(*ntlmContext); ok {
+		return c.flags
+	}
+	return 0
+}
+
+// verify checks the last token of the peer, sent with the response that
+// ends the handshake, if any.
+func (h *clientHandshake) verify(token []byte) error {
+	if len(token) == 0 {
+		return nil
+	}
+	if !h.spnego {
+		if h.complete {
+			return nil
+		}
+		_, err := h.step(token, nil)
+		return err
+	}
+	var resp NegTokenResp
+	if err := resp.UnmarshalBinary(token); err != nil {
+		h.logger.Debug("error parsing final negTokenResp", "error", err)
+		return err
+	}
+	if resp.NegState != nil && *resp.NegState == NegStateReject {
+		h.logger.Debug("authentication rejected")
+		return fmt.Errorf("%w: negotiation rejected", ErrInvalidCredentials)
+	}
+	if resp.ResponseToken != nil && !h.complete {
+		// mutual authentication, such as the Kerberos AP-REP
+		if _, err := h.step(resp.ResponseToken, nil); err != nil {
+			return err
+		}
+		if !h.complete {
+			h.logger.Debug("security context not established by the final token")
+			return ErrHandshakeIncomplete
+		}
+	}
+	if resp.MechListMIC != nil && h.complete {
+		if err := h.ctx.VerifyMIC(h.mechTypes, resp.MechListMIC); err != nil && !errors.Is(err, ErrNotNegotiated) {
+			h.logger.Debug("invalid mechListMIC")
+			return fmt.Errorf("%w: mechListMIC: %w", ErrInvalidMIC, err)
+		}
+	}
+	return nil
+}
+
+// tokenFlags returns the flags of token if it is a raw CHALLENGE message, for errors.
+func tokenFlags(token []byte) NegotiateFlags {
+	if !isNTLMMessage(token) {
+		return 0
+	}
+	return challengeFlags(token)
+}
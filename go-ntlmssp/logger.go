@@ -0,0 +1,34 @@
+package ntlmssp
+
+import (
+	"log/slog"
+	"sync/atomic"
+)
+
+var packageLogger atomic.Pointer[slog.Logger]
+
+// SetLogger sets the logger used by the package, and by the Negotiator,
+// Server and ProxyDialer values that have no Logger of their own. A nil
+// logger restores the default, slog.Default().
+//
+// Handshake steps and errors are logged at debug level, insecure settings
+// at warn level. Passwords, hashes, session keys and NTLM messages are never
+// logged.
+func SetLogger(l *slog.Logger) {
+	packageLogger.Store(l)
+}
+
+func logger() *slog.Logger {
+	if l := packageLogger.Load(); l != nil {
+		return l
+	}
+	return slog.Default()
+}
+
+// loggerOr returns l, or the package logger if l is nil
+func loggerOr(l *slog.Logger) *slog.Logger {
+	if l != nil {
+		return l
+	}
+	return logger()
+}
@@ -0,0 +1,240 @@
+package ntlmssp
+
+import (
+	"encoding/asn1"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// Object identifiers of the Kerberos mechanism, and of the variant with the
+// wrong OID sent by old Windows versions
+var (
+	MechTypeKerberos   = asn1.ObjectIdentifier{1, 2, 840, 113554, 1, 2, 2}
+	MechTypeMSKerberos = asn1.ObjectIdentifier{1, 2, 840, 48018, 1, 2, 2}
+)
+
+// Mechanism is a GSS-API security mechanism the Negotiate scheme can select
+// with SPNEGO, such as NTLM or Kerberos.
+type Mechanism interface {
+	// OID identifies the mechanism in SPNEGO tokens
+	OID() asn1.ObjectIdentifier
+
+	// NewSecContext starts a security context authenticating creds to the
+	// server or proxy named target, a host name. Integrity requests the
+	// ability to sign messages, for the SPNEGO mechListMIC. An error makes
+	// the Negotiator fall back to the next mechanism.
+	NewSecContext(target string, creds *Credentials, integrity bool) (SecContext, error)
+}
+
+// SecContext is the client side of a security context, in the style of
+// GSS_Init_sec_context.
+type SecContext interface {
+	// InitSecContext processes the token of the peer, nil on the first call,
+	// and returns the token to send to it, if any. Complete reports that the
+	// context is established and no more tokens are expected from the peer.
+	//
+	// Bindings are the channel bindings of the TLS connection to the server,
+	// known once it has answered. They are nil on the first call.
+	InitSecContext(input []byte, bindings *ChannelBindings) (output []byte, complete bool, err error)
+
+	// GetMIC signs message with the established context, it returns
+	// ErrNotNegotiated if the context cannot sign
+	GetMIC(message []byte) ([]byte, error)
+
+	// VerifyMIC checks the signature of the peer for message
+	VerifyMIC(message, mic []byte) error
+}
+
+// NTLMMechanism is the NTLM mechanism, built in.
+type NTLMMechanism struct {
+	// CodePage, when set, offers OEM encoding with it to servers that do not
+	// support Unicode, such as old appliances
+	CodePage *CodePage
+
+	// InsecureNTLMv1 sends NTLMv1 or NTLM2 session responses instead of
+	// NTLMv2, see ChallengeOptions. Only set it for legacy servers.
+	InsecureNTLMv1 bool
+
+	// Version is sent in the NEGOTIATE and AUTHENTICATE messages,
+	// DefaultVersion() if nil
+	Version *Version
+}
+
+// OID returns MechTypeNTLMSSP.
+func (NTLMMechanism) OID() asn1.ObjectIdentifier {
+	return MechTypeNTLMSSP
+}
+
+// NewSecContext starts a NTLM handshake with creds.
+func (m NTLMMechanism) NewSecContext(target string, creds *Credentials, integrity bool) (SecContext, error) {
+	return m.newSecContext(target, creds, integrity, logger())
+}
+
+// newSecContext starts a NTLM handshake with creds, logging to logger.
+func (m NTLMMechanism) newSecContext(target string, creds *Credentials, integrity bool, logger *slog.Logger) (SecContext, error) {
+	c := newNTLMContext(creds, integrity, logger)
+	c.codePage, c.insecureNTLMv1, c.version = m.CodePage, m.InsecureNTLMv1, m.Version
+	if m.InsecureNTLMv1 {
+		logger.Warn("ntlm v1 enabled, responses are easily cracked", "target", target)
+	}
+	return c, nil
+}
+
+// loggingMechanism is implemented by the built-in mechanisms, whose contexts
+// log to the logger of the Negotiator
+type loggingMechanism interface {
+	newSecContext(target string, creds *Credentials, integrity bool, logger *slog.Logger) (SecContext, error)
+}
+
+// KerberosMechanism plugs a Kerberos implementation, such as one backed by
+// gokrb5 and a keytab, into the Negotiate scheme.
+type KerberosMechanism struct {
+	// NewContext starts a security context for the service principal name
+	// of the server, HTTP/<host>. Creds are the credentials of the request,
+	// the implementation may use its own instead.
+	NewContext func(spn string, creds *Credentials, integrity bool) (SecContext, error)
+}
+
+// OID returns MechTypeKerberos.
+func (KerberosMechanism) OID() asn1.ObjectIdentifier {
+	return MechTypeKerberos
+}
+
+// NewSecContext calls m.NewContext with the service principal name of target.
+func (m KerberosMechanism) NewSecContext(target string, creds *Credentials, integrity bool) (SecContext, error) {
+	if m.NewContext == nil {
+		return nil, fmt.Errorf("%w: no kerberos implementation", ErrNoMechanism)
+	}
+	return m.NewContext("HTTP/"+target, creds, integrity)
+}
+
+// defaultMechanisms are used when none are configured
+var defaultMechanisms = []Mechanism{NTLMMechanism{}}
+
+// mechEqual reports whether oid names the mechanism m, accepting the
+// Microsoft variant of the Kerberos OID.
+func mechEqual(m Mechanism, oid asn1.ObjectIdentifier) bool {
+	if oid.Equal(MechTypeMSKerberos) {
+		oid = MechTypeKerberos
+	}
+	return m.OID().Equal(oid)
+}
+
+// ntlmContext is the client side of a NTLM handshake using Credentials.
+type ntlmContext struct {
+	creds          *Credentials
+	user           string
+	domain         string
+	domainNeeded   bool
+	integrity      bool
+	codePage       *CodePage
+	insecureNTLMv1 bool
+	version        *Version
+	logger         *slog.Logger
+
+	negotiateMessage []byte
+	flags            NegotiateFlags
+	session          *Session
+	complete         bool
+}
+
+func newNTLMContext(creds *Credentials, integrity bool, logger *slog.Logger) *ntlmContext {
+	// get domain from username
+	u, domain, domainNeeded := GetDomain(creds.User)
+	if creds.Domain != "" {
+		domain, domainNeeded = creds.Domain, true
+	}
+	if creds.Anonymous {
+		u, domain = "", ""
+	}
+	return &ntlmContext{
+		creds:        creds,
+		user:         u,
+		domain:       domain,
+		domainNeeded: domainNeeded,
+		integrity:    integrity,
+		logger:       logger,
+	}
+}
+
+// InitSecContext returns the NEGOTIATE message, then answers the CHALLENGE
+// message with the AUTHENTICATE message.
+func (c *ntlmContext) InitSecContext(input []byte, bindings *ChannelBindings) ([]byte, bool, error) {
+	switch {
+	case c.complete:
+		c.logger.Debug("unexpected token after the authenticate message")
+		return nil, true, fmt.Errorf("%w: unexpected token after the authenticate message", ErrInvalidMessage)
+	case c.negotiateMessage == nil:
+		flags := defaultFlags
+		if c.integrity {
+			flags |= sessionFlags
+		}
+		var err error
+		c.negotiateMessage, err = newNegotiateMessage(c.domain, c.creds.Workstation, flags, c.codePage, c.version)
+		if err != nil {
+			c.logger.Debug("error creating negotiate message", "error", err)
+			return nil, false, err
+		}
+		return c.negotiateMessage, false, nil
+	}
+
+	c.flags = challengeFlags(input)
+	opts := ChallengeOptions{
+		NegotiateMessage: c.negotiateMessage,
+		ChannelBindings:  bindings,
+		CodePage:         c.codePage,
+		InsecureNTLMv1:   c.insecureNTLMv1,
+		Anonymous:        c.creds.Anonymous,
+		Domain:           c.domain,
+		Workstation:      strings.ToUpper(c.creds.Workstation),
+		Version:          c.version,
+		logger:           c.logger,
+	}
+	var authenticateMessage, exportedSessionKey []byte
+	var err error
+	if c.creds.Hash != "" && !c.creds.Anonymous {
+		var ntHash []byte
+		ntHash, err = decodeNtlmHash(c.creds.Hash)
+		if err == nil {
+			authenticateMessage, exportedSessionKey, err = processChallenge(input, c.user, ntHash, nil, c.domainNeeded, opts)
+		}
+	} else {
+		authenticateMessage, exportedSessionKey, err = ProcessChallengeWithOptions(input, c.user, c.creds.Password, c.domainNeeded, opts)
+	}
+	if err != nil {
+		c.logger.Debug("error processing challenge", "error", err)
+		return nil, false, err
+	}
+	var am AuthenticateMessage
+	if err := am.UnmarshalBinary(authenticateMessage); err != nil {
+		return nil, false, err
+	}
+	c.logger.Debug("authenticate message created", "flags", am.NegotiateFlags.String(),
+		"channel_bindings", bindings != nil, "mic", am.MIC != nil, "anonymous", c.creds.Anonymous)
+
+	if am.NegotiateFlags.Has(negotiateFlagNTLMSSPNEGOTIATESIGN) && am.NegotiateFlags.Has(negotiateFlagNTLMSSPNEGOTIATEEXTENDEDSESSIONSECURITY) {
+		c.session, err = newSession(am.NegotiateFlags, exportedSessionKey, true)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	c.complete = true
+	return authenticateMessage, true, nil
+}
+
+// GetMIC signs message with the session of the handshake.
+func (c *ntlmContext) GetMIC(message []byte) ([]byte, error) {
+	if c.session == nil {
+		return nil, ErrNotNegotiated
+	}
+	return c.session.Sign(message)
+}
+
+// VerifyMIC checks the signature of message with the session of the handshake.
+func (c *ntlmContext) VerifyMIC(message, mic []byte) error {
+	if c.session == nil {
+		return ErrNotNegotiated
+	}
+	return c.session.Verify(message, mic)
+}
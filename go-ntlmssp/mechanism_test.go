@@ -0,0 +1,177 @@
+package ntlmssp
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// testKDC stands in for a KDC and the Kerberos mechanism: it issues tickets
+// as "AP-REQ <spn>" tokens, answered with "AP-REP <spn>", and signs with a
+// key shared by the client and the server.
+type testKDC struct {
+	key         []byte
+	unavailable bool
+	established bool
+}
+
+func (k *testKDC) mechanism() KerberosMechanism {
+	return KerberosMechanism{NewContext: func(spn string, creds *Credentials, integrity bool) (SecContext, error) {
+		if k.unavailable {
+			return nil, errors.New("no ticket")
+		}
+		return &testKerberosContext{kdc: k, spn: spn}, nil
+	}}
+}
+
+func (k *testKDC) mic(message []byte) []byte {
+	mac := hmac.New(sha256.New, k.key)
+	mac.Write(message)
+	return mac.Sum(nil)[:16]
+}
+
+type testKerberosContext struct {
+	kdc *testKDC
+	spn string
+}
+
+func (c *testKerberosContext) InitSecContext(input []byte, bindings *ChannelBindings) ([]byte, bool, error) {
+	if input == nil {
+		return []byte("AP-REQ " + c.spn), false, nil
+	}
+	if string(input) != "AP-REP "+c.spn {
+		return nil, false, errors.New("invalid ap-rep")
+	}
+	c.kdc.established = true
+	return nil, true, nil
+}
+
+func (c *testKerberosContext) GetMIC(message []byte) ([]byte, error) {
+	return c.kdc.mic(message), nil
+}
+
+func (c *testKerberosContext) VerifyMIC(message, mic []byte) error {
+	if !hmac.Equal(mic, c.kdc.mic(message)) {
+		return ErrSignatureMismatch
+	}
+	return nil
+}
+
+// kerberosHandler accepts the AP-REQ of kdc in one leg
+func kerberosHandler(t *testing.T, kdc *testKDC) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, _ := authheader(r.Header.Values("Authorization")).GetData()
+		var init NegTokenInit
+		if token == nil || init.UnmarshalBinary(token) != nil || !init.MechTypes[0].Equal(MechTypeKerberos) {
+			w.Header().Set("Www-Authenticate", "Negotiate")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		host, _, _ := net.SplitHostPort(r.Host)
+		spn := "HTTP/" + host
+		if string(init.MechToken) != "AP-REQ "+spn {
+			t.Errorf("unexpected ap-req %q", init.MechToken)
+		}
+		mechTypes, _ := asn1.Marshal(init.MechTypes)
+		state := NegStateAcceptCompleted
+		final, _ := NegTokenResp{
+			NegState:      &state,
+			SupportedMech: MechTypeKerberos,
+			ResponseToken: []byte("AP-REP " + spn),
+			MechListMIC:   kdc.mic(mechTypes),
+		}.MarshalBinary()
+		w.Header().Set("Www-Authenticate", "Negotiate "+base64.StdEncoding.EncodeToString(final))
+	})
+}
+
+func TestNegotiatorMechanisms(t *testing.T) {
+	ntlm := newTestServer()
+	ntlm.Negotiate = true
+	ntlmServer := httptest.NewServer(ntlm.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	defer ntlmServer.Close()
+
+	for _, table := range []struct {
+		name        string
+		kerberos    bool
+		unavailable bool
+		serverKey   []byte
+		err         error
+		established bool
+	}{
+		{"kerberos", true, false, []byte("key"), nil, true},
+		{"kerberos wrong mic", true, false, []byte("other key"), ErrInvalidMIC, true},
+		{"ntlm selected by server", false, false, nil, nil, false},
+		{"kerberos unavailable", false, true, nil, nil, false},
+	} {
+		t.Run(table.name, func(t *testing.T) {
+			kdc := &testKDC{key: []byte("key"), unavailable: table.unavailable}
+			url := ntlmServer.URL
+			if table.kerberos {
+				ts := httptest.NewServer(kerberosHandler(t, &testKDC{key: table.serverKey}))
+				defer ts.Close()
+				url = ts.URL
+			}
+			client := &http.Client{Transport: Negotiator{
+				RoundTripper: &http.Transport{},
+				Mechanisms:   []Mechanism{kdc.mechanism(), NTLMMechanism{}},
+			}}
+			req, _ := http.NewRequest("GET", url, nil)
+			req.SetBasicAuth(domain+"\\"+username, password)
+			res, err := client.Do(req)
+			if !errors.Is(err, table.err) {
+				t.Fatalf("expected error %v, got %v", table.err, err)
+			}
+			if err != nil {
+				return
+			}
+			res.Body.Close()
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("expected status 200, got %d", res.StatusCode)
+			}
+			if kdc.established != table.established {
+				t.Fatalf("expected kerberos context established %v, got %v", table.established, kdc.established)
+			}
+		})
+	}
+}
+
+func TestNTLMContextDomain(t *testing.T) {
+	cm := newTestChallengeMessage(t, defaultFlags, marshalAVPairs(AVPairs{
+		{MsvAvNbDomainName, toUnicode(target)},
+		{MsvAvTimestamp, []byte{0x00, 0x90, 0xd3, 0x36, 0xb7, 0x34, 0xc3, 0x01}},
+	}))
+	for _, table := range []struct {
+		creds  *Credentials
+		domain string
+	}{
+		{&Credentials{User: username, Password: password, Domain: domain}, domain},
+		{&Credentials{User: domain + "\\" + username, Password: password}, domain},
+		{&Credentials{User: username, Password: password}, target},
+	} {
+		c, err := NTLMMechanism{}.NewSecContext("", table.creds, false)
+		if err != nil {
+			t.Fatalf("error creating context: %s", err)
+		}
+		if _, _, err := c.InitSecContext(nil, nil); err != nil {
+			t.Fatalf("error creating negotiate message: %s", err)
+		}
+		token, _, err := c.InitSecContext(cm, nil)
+		if err != nil {
+			t.Fatalf("error processing challenge: %s", err)
+		}
+		var am AuthenticateMessage
+		if err := am.UnmarshalBinary(token); err != nil {
+			t.Fatalf("error parsing authenticate message: %s", err)
+		}
+		if am.DomainName != table.domain {
+			t.Fatalf("expected domain %q for %+v, got %q", table.domain, table.creds, am.DomainName)
+		}
+		checkNTLMv2Response(t, am, username, table.domain)
+	}
+}
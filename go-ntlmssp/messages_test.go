@@ -0,0 +1,213 @@
+package ntlmssp
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestMessagesRoundTrip(t *testing.T) {
+	version := DefaultVersion()
+	targetInfo := marshalAVPairs(AVPairs{
+		{MsvAvNbDomainName, toUnicode(target)},
+		{MsvAvTimestamp, []byte{0x00, 0x90, 0xd3, 0x36, 0xb7, 0x34, 0xc3, 0x01}},
+	})
+
+	accepted := NegStateAcceptCompleted
+	tables := []struct {
+		m encoding.BinaryMarshaler
+		u encoding.BinaryUnmarshaler
+	}{
+		{NegotiateMessage{
+			NegotiateFlags: defaultFlags | negotiateFlagNTLMSSPNEGOTIATEOEMDOMAINSUPPLIED | negotiateFlagNTLMSSPNEGOTIATEOEMWORKSTATIONSUPPLIED,
+			DomainName:     domain,
+			Workstation:    workstation,
+			Version:        &version,
+		}, &NegotiateMessage{}},
+		{NegotiateMessage{NegotiateFlags: defaultFlags}, &NegotiateMessage{}},
+		{ChallengeMessage{
+			NegotiateFlags:  defaultFlags | negotiateFlagNTLMSSPNEGOTIATEVERSION,
+			TargetName:      target,
+			ServerChallenge: [8]byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef},
+			TargetInfo:      targetInfo,
+			Version:         &version,
+		}, &ChallengeMessage{}},
+		{ChallengeMessage{NegotiateFlags: defaultFlags}, &ChallengeMessage{}},
+		{AuthenticateMessage{
+			LmChallengeResponse:       bytes.Repeat([]byte{0x01}, 24),
+			NtChallengeResponse:       bytes.Repeat([]byte{0x02}, 64),
+			DomainName:                target,
+			UserName:                  username,
+			Workstation:               workstation,
+			EncryptedRandomSessionKey: bytes.Repeat([]byte{0x03}, 16),
+			NegotiateFlags:            defaultFlags | negotiateFlagNTLMSSPNEGOTIATEKEYEXCH | negotiateFlagNTLMSSPNEGOTIATEVERSION,
+			Version:                   &version,
+			MIC:                       bytes.Repeat([]byte{0x04}, 16),
+		}, &AuthenticateMessage{}},
+		{AuthenticateMessage{
+			NtChallengeResponse: bytes.Repeat([]byte{0x02}, 64),
+			UserName:            username,
+			NegotiateFlags:      defaultFlags,
+		}, &AuthenticateMessage{}},
+		{NegotiateMessage{
+			NegotiateFlags: negotiateFlagNTLMNEGOTIATEOEM | negotiateFlagNTLMSSPNEGOTIATEOEMDOMAINSUPPLIED,
+			DomainName:     "ÅRHUS",
+			CodePage:       CodePage1252,
+		}, &NegotiateMessage{CodePage: CodePage1252}},
+		{AuthenticateMessage{
+			NtChallengeResponse: bytes.Repeat([]byte{0x02}, 64),
+			UserName:            "björn",
+			DomainName:          "ÅRHUS",
+			NegotiateFlags:      negotiateFlagNTLMNEGOTIATEOEM,
+			CodePage:            CodePage437,
+		}, &AuthenticateMessage{CodePage: CodePage437}},
+		{NegTokenInit{
+			MechTypes: []asn1.ObjectIdentifier{MechTypeNTLMSSP},
+			MechToken: []byte("NTLMSSP\x00\x01"),
+		}, &NegTokenInit{}},
+		{NegTokenResp{
+			NegState:      &accepted,
+			SupportedMech: MechTypeNTLMSSP,
+			ResponseToken: []byte("NTLMSSP\x00\x02"),
+			MechListMIC:   bytes.Repeat([]byte{0x05}, 16),
+		}, &NegTokenResp{}},
+		{NegTokenResp{ResponseToken: []byte("NTLMSSP\x00\x03")}, &NegTokenResp{}},
+	}
+
+	for _, table := range tables {
+		b, err := table.m.MarshalBinary()
+		if err != nil {
+			t.Fatalf("error marshaling %T: %s", table.m, err)
+		}
+		if err := table.u.UnmarshalBinary(b); err != nil {
+			t.Fatalf("error unmarshaling %T: %s", table.m, err)
+		}
+		if u := reflect.ValueOf(table.u).Elem().Interface(); !reflect.DeepEqual(u, table.m) {
+			t.Fatalf("expected %+v, got %+v", table.m, u)
+		}
+		b2, err := table.u.(encoding.BinaryMarshaler).MarshalBinary()
+		if err != nil {
+			t.Fatalf("error marshaling %T: %s", table.u, err)
+		}
+		if !bytes.Equal(b, b2) {
+			t.Fatalf("expected %x, got %x", b, b2)
+		}
+	}
+
+	if _, err := (AuthenticateMessage{UserName: username}).MarshalBinary(); !errors.Is(err, ErrNoEncodingNegotiated) {
+		t.Fatalf("expected %v, got %v", ErrNoEncodingNegotiated, err)
+	}
+}
+
+func TestNegotiateMessageUnmarshal(t *testing.T) {
+	b, err := NewNegotiateMessage(domain, workstation)
+	if err != nil {
+		t.Fatalf("error creating negotiate message: %s", err)
+	}
+	var m NegotiateMessage
+	if err := m.UnmarshalBinary(b); err != nil {
+		t.Fatalf("error unmarshaling negotiate message: %s", err)
+	}
+	if m.DomainName != domain || m.Workstation != workstation || m.Version == nil || *m.Version != DefaultVersion() {
+		t.Fatalf("unexpected negotiate message %+v", m)
+	}
+	if !m.NegotiateFlags.Has(negotiateFlagNTLMSSPNEGOTIATEUNICODE) {
+		t.Fatalf("expected unicode flag in %s", m.NegotiateFlags)
+	}
+}
+
+func TestNegotiateMessageNonLatin(t *testing.T) {
+	b, err := NewNegotiateMessage("домен", "工作站")
+	if err != nil {
+		t.Fatalf("error creating negotiate message: %s", err)
+	}
+	if !bytes.Contains(b, []byte("ДОМЕН工作站")) {
+		t.Fatalf("expected the names as is, got %x", b)
+	}
+
+	// the names the offered code page cannot encode are left out
+	b, err = newNegotiateMessage("домен", workstation, defaultFlags, CodePage850, nil)
+	if err != nil {
+		t.Fatalf("error creating negotiate message: %s", err)
+	}
+	m := NegotiateMessage{CodePage: CodePage850}
+	if err := m.UnmarshalBinary(b); err != nil {
+		t.Fatalf("error unmarshaling negotiate message: %s", err)
+	}
+	if m.DomainName != "" || m.Workstation != workstation || m.NegotiateFlags.Has(negotiateFlagNTLMSSPNEGOTIATEOEMDOMAINSUPPLIED) {
+		t.Fatalf("unexpected negotiate message %+v", m)
+	}
+
+	if _, err := (NegotiateMessage{DomainName: "домен", CodePage: CodePage850}).MarshalBinary(); !errors.Is(err, ErrNotEncodable) {
+		t.Fatalf("expected %v, got %v", ErrNotEncodable, err)
+	}
+}
+
+func TestMalformedChallengeMessage(t *testing.T) {
+	valid, err := ChallengeMessage{NegotiateFlags: defaultFlags, ServerChallenge: nlmpServerChallenge}.MarshalBinary()
+	if err != nil {
+		t.Fatalf("error creating challenge message: %s", err)
+	}
+	var manyPairs AVPairs
+	for i := 0; i <= maxAVPairs; i++ {
+		manyPairs = append(manyPairs, AVPair{AVID(0x100 + i), nil})
+	}
+	withTargetInfo := func(offset uint32, pairs []byte) []byte {
+		b := append(append([]byte{}, valid...), pairs...)
+		binary.LittleEndian.PutUint16(b[40:], uint16(len(pairs)))
+		binary.LittleEndian.PutUint32(b[44:], offset)
+		return b
+	}
+	for _, table := range []struct {
+		name string
+		data []byte
+	}{
+		{"overflowing target info", withTargetInfo(0xffffffff, []byte{0x00, 0x00, 0x00, 0x00})},
+		{"target info not terminated", withTargetInfo(uint32(len(valid)), []byte{0x01, 0x00, 0x02, 0x00, 0x41, 0x00})},
+		{"short av pair", withTargetInfo(uint32(len(valid)), []byte{0x01, 0x00, 0xff, 0x00, 0x41, 0x00})},
+		{"duplicate av pair", withTargetInfo(uint32(len(valid)), marshalAVPairs(AVPairs{
+			{MsvAvNbDomainName, toUnicode(target)},
+			{MsvAvNbDomainName, toUnicode(domain)},
+		}))},
+		{"short timestamp", withTargetInfo(uint32(len(valid)), marshalAVPairs(AVPairs{{MsvAvTimestamp, []byte{0x01}}}))},
+		{"too many av pairs", withTargetInfo(uint32(len(valid)), marshalAVPairs(manyPairs))},
+	} {
+		var cm challengeMessage
+		if err := cm.UnmarshalBinary(table.data); !errors.Is(err, ErrInvalidMessage) {
+			t.Errorf("%s: expected %v, got %v", table.name, ErrInvalidMessage, err)
+		}
+	}
+}
+
+func TestGetBasicCreds(t *testing.T) {
+	for _, table := range []struct {
+		creds, user, password string
+		err                   error
+	}{
+		{"user:pass:word", "user", "pass:word", nil},
+		{"user:", "user", "", nil},
+		{"user", "", "", ErrInvalidBasicAuth},
+	} {
+		h := authheader{"Basic " + base64.StdEncoding.EncodeToString([]byte(table.creds))}
+		user, password, err := h.GetBasicCreds()
+		if !errors.Is(err, table.err) || user != table.user || password != table.password {
+			t.Errorf("%q: expected %q, %q, %v, got %q, %q, %v", table.creds, table.user, table.password, table.err, user, password, err)
+		}
+	}
+}
+
+func TestNegotiateFlags(t *testing.T) {
+	flags := NegotiateFlagUnicode | NegotiateFlagSign | NegotiateFlagKeyExch
+	if !flags.Has(NegotiateFlagUnicode|NegotiateFlagKeyExch) || flags.Has(NegotiateFlagSeal) {
+		t.Fatalf("unexpected flags %s", flags)
+	}
+	flags.Unset(NegotiateFlagSign | NegotiateFlagSeal)
+	if expected := "NTLMSSP_NEGOTIATE_UNICODE|NTLMSSP_NEGOTIATE_KEY_EXCH"; flags.String() != expected {
+		t.Fatalf("expected %s, got %s", expected, flags)
+	}
+}
@@ -0,0 +1,250 @@
+package ntlmssp
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"testing"
+	"time"
+)
+
+// test cases from MS-NLMP 4.2, https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-nlmp/96ebf7f2-8d4f-47ef-9a6a-7d3fd5ad1f4e
+
+// common values of MS-NLMP 4.2.1
+var (
+	nlmpUser               = "User"
+	nlmpUserDom            = "Domain"
+	nlmpPassword           = "Password"
+	nlmpServerName         = "Server"
+	nlmpWorkstation        = "COMPUTER"
+	nlmpRandomSessionKey   = bytes.Repeat([]byte{0x55}, 16)
+	nlmpClientChallenge    = bytes.Repeat([]byte{0xaa}, 8)
+	nlmpServerChallenge    = [8]byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef}
+	nlmpPlaintext          = toUnicode("Plaintext")
+	nlmpTime               = time.Date(1601, time.January, 1, 0, 0, 0, 0, time.UTC)
+	nlmpServerVersion      = Version{ProductMajorVersion: 6, ProductBuild: 6000, NTLMRevisionCurrent: 15}
+	nlmpTargetInfo         = unhex("02000c0044006f006d00610069006e0001000c005300650072007600650072000000" + "0000")
+	nlmpNTOWFv1            = unhex("a4f49c406510bdcab6824ee7c30fd852")
+	nlmpLMOWFv1            = unhex("e52cac67419a9a224a3b108f3fa6cb6d")
+	nlmpNTOWFv2            = unhex("0c868a403bfd7a93a3001ef22ef02e3f")
+	nlmpNTLMv1SessionKey   = unhex("d87262b0cde4b1cb7499becccdf10784")
+	nlmpNTLMv2SessionKey   = unhex("8de40ccadbc14a82f15cb0ad0de95ca3")
+	nlmpNTLMv1Response     = unhex("67c43011f30298a2ad35ece64f16331c44bdbed927841f94")
+	nlmpLMv1Response       = unhex("98def7b87f88aa5dafe2df779688a172def11c7d5ccdef13")
+	nlmpNTLM2SessionNT     = unhex("7537f803ae367128ca458204bde7caf81e97ed2683267232")
+	nlmpNTLM2SessionKXKey  = unhex("eb93429a8bd952f8b89c55b87f475edc")
+	nlmpLMv2Response       = unhex("86c35097ac9cec102554764a57cccc19aaaaaaaaaaaaaaaa")
+	nlmpNTProofStr         = unhex("68cd0ab851e51c96aabc927bebef6a1c")
+	nlmpNTLMv2EncryptedKey = unhex("c5dad2544fc9799094ce1ce90bc9d03e")
+)
+
+func unhex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// nlmpChallenge returns the CHALLENGE message of the server of MS-NLMP 4.2
+func nlmpChallenge(t *testing.T, flags NegotiateFlags, targetInfo []byte) []byte {
+	t.Helper()
+	b, err := ChallengeMessage{
+		NegotiateFlags:  flags,
+		TargetName:      nlmpServerName,
+		ServerChallenge: nlmpServerChallenge,
+		TargetInfo:      targetInfo,
+		Version:         &nlmpServerVersion,
+	}.MarshalBinary()
+	if err != nil {
+		t.Fatalf("error creating challenge message: %s", err)
+	}
+	return b
+}
+
+// nlmpOptions returns the options injecting the client challenge and random
+// session key of MS-NLMP 4.2.1
+func nlmpOptions(opts ChallengeOptions) ChallengeOptions {
+	opts.Domain = nlmpUserDom
+	opts.Workstation = nlmpWorkstation
+	opts.Rand = bytes.NewReader(append(append([]byte{}, nlmpClientChallenge...), nlmpRandomSessionKey...))
+	opts.Now = func() time.Time { return nlmpTime }
+	return opts
+}
+
+func TestMSNLMPKeys(t *testing.T) {
+	for _, table := range []struct {
+		name     string
+		v        []byte
+		expected []byte
+	}{
+		{"4.2.2.1.1 LMOWFv1", getLmHash(nlmpPassword, nil), nlmpLMOWFv1},
+		{"4.2.2.1.2 NTOWFv1", getNtlmHash(nlmpPassword), nlmpNTOWFv1},
+		{"4.2.2.1 session base key", md4Sum(nlmpNTOWFv1), nlmpNTLMv1SessionKey},
+		{"4.2.4.1.1 NTOWFv2", getNtlmV2Hash(nlmpPassword, nlmpUser, nlmpUserDom), nlmpNTOWFv2},
+		{"4.2.4.1.2 session base key", computeNtlmV2SessionBaseKey(nlmpNTOWFv2, nlmpNTProofStr), nlmpNTLMv2SessionKey},
+	} {
+		if !bytes.Equal(table.v, table.expected) {
+			t.Errorf("%s: expected %x, got %x", table.name, table.expected, table.v)
+		}
+	}
+}
+
+func TestMSNLMPNTLMv1(t *testing.T) {
+	// MS-NLMP 4.2.2.3, the server does not negotiate extended session security
+	flags := NegotiateFlags(0xe2028233)
+	for _, table := range []struct {
+		name           string
+		flags          NegotiateFlags
+		keyExchangeKey []byte
+		encryptedKey   []byte
+	}{
+		{"4.2.2", flags, nlmpNTLMv1SessionKey, unhex("518822b1b3f350c8958682ecbb3e3cb7")},
+		{"4.2.2 NTLMSSP_NEGOTIATE_LM_KEY", flags | negotiateFlagNTLMSSPNEGOTIATELMKEY,
+			unhex("b09e379f7fbecb1eaf0afdcb0383c8a0"), unhex("4cd7bb57d697ef9b549f02b8f9b37864")},
+		{"4.2.2 NTLMSSP_REQUEST_NON_NT_SESSION_KEY", flags | negotiateFlagNTLMSSPREQUESTNONNTSESSIONKEY,
+			unhex("e52cac67419a9a220000000000000000"), unhex("7452ca55c225a1ca04b48fae32cf56fc")},
+	} {
+		_, _, keyExchangeKey, err := computeNtlmV1Response(table.flags, nlmpNTOWFv1, nlmpLMOWFv1, nlmpServerChallenge[:], nlmpClientChallenge)
+		if err != nil {
+			t.Fatalf("%s: error computing responses: %s", table.name, err)
+		}
+		if !bytes.Equal(keyExchangeKey, table.keyExchangeKey) {
+			t.Fatalf("%s: expected key exchange key %x, got %x", table.name, table.keyExchangeKey, keyExchangeKey)
+		}
+
+		b, sessionKey, err := ProcessChallengeWithOptions(nlmpChallenge(t, table.flags, nil), nlmpUser, nlmpPassword, true,
+			nlmpOptions(ChallengeOptions{InsecureNTLMv1: true}))
+		if err != nil {
+			t.Fatalf("%s: error processing challenge: %s", table.name, err)
+		}
+		var am AuthenticateMessage
+		if err := am.UnmarshalBinary(b); err != nil {
+			t.Fatalf("%s: error parsing authenticate message: %s", table.name, err)
+		}
+		if !bytes.Equal(am.NtChallengeResponse, nlmpNTLMv1Response) || !bytes.Equal(am.LmChallengeResponse, nlmpLMv1Response) {
+			t.Fatalf("%s: expected responses %x and %x, got %x and %x", table.name,
+				nlmpNTLMv1Response, nlmpLMv1Response, am.NtChallengeResponse, am.LmChallengeResponse)
+		}
+		if !bytes.Equal(am.EncryptedRandomSessionKey, table.encryptedKey) || !bytes.Equal(sessionKey, nlmpRandomSessionKey) {
+			t.Fatalf("%s: expected encrypted session key %x, got %x", table.name, table.encryptedKey, am.EncryptedRandomSessionKey)
+		}
+
+		// signing and sealing without extended session security are not implemented
+		if _, err := NewClientSession(b, sessionKey); !errors.Is(err, ErrNotNegotiated) {
+			t.Fatalf("%s: expected %v, got %v", table.name, ErrNotNegotiated, err)
+		}
+	}
+}
+
+func TestMSNLMPNTLM2Session(t *testing.T) {
+	// MS-NLMP 4.2.3.3, extended session security without key exchange
+	cm := nlmpChallenge(t, NegotiateFlags(0x820a8233), nil)
+	b, sessionKey, err := ProcessChallengeWithOptions(cm, nlmpUser, nlmpPassword, true, nlmpOptions(ChallengeOptions{InsecureNTLMv1: true}))
+	if err != nil {
+		t.Fatalf("error processing challenge: %s", err)
+	}
+	var am AuthenticateMessage
+	if err := am.UnmarshalBinary(b); err != nil {
+		t.Fatalf("error parsing authenticate message: %s", err)
+	}
+	if expected := append(append([]byte{}, nlmpClientChallenge...), make([]byte, 16)...); !bytes.Equal(am.LmChallengeResponse, expected) {
+		t.Fatalf("expected LM response %x, got %x", expected, am.LmChallengeResponse)
+	}
+	if !bytes.Equal(am.NtChallengeResponse, nlmpNTLM2SessionNT) {
+		t.Fatalf("expected NT response %x, got %x", nlmpNTLM2SessionNT, am.NtChallengeResponse)
+	}
+	if am.EncryptedRandomSessionKey != nil || !bytes.Equal(sessionKey, nlmpNTLM2SessionKXKey) {
+		t.Fatalf("expected the key exchange key %x as session key, got %x", nlmpNTLM2SessionKXKey, sessionKey)
+	}
+
+	// MS-NLMP 4.2.3.4
+	session, err := NewClientSession(b, sessionKey)
+	if err != nil {
+		t.Fatalf("error creating session: %s", err)
+	}
+	sealed, signature, err := session.Seal(nlmpPlaintext)
+	if err != nil {
+		t.Fatalf("error sealing message: %s", err)
+	}
+	if expected := unhex("a02372f6530273f3aa1eb90190ce5200c99d"); !bytes.Equal(sealed, expected) {
+		t.Fatalf("expected sealed data %x, got %x", expected, sealed)
+	}
+	if expected := unhex("01000000ff2aeb52f681793a00000000"); !bytes.Equal(signature, expected) {
+		t.Fatalf("expected signature %x, got %x", expected, signature)
+	}
+}
+
+func TestMSNLMPNTLMv2(t *testing.T) {
+	// MS-NLMP 4.2.4.3
+	cm := nlmpChallenge(t, NegotiateFlags(0xe28a8233), nlmpTargetInfo)
+	b, sessionKey, err := ProcessChallengeWithOptions(cm, nlmpUser, nlmpPassword, true, nlmpOptions(ChallengeOptions{}))
+	if err != nil {
+		t.Fatalf("error processing challenge: %s", err)
+	}
+	if !bytes.Equal(sessionKey, nlmpRandomSessionKey) {
+		t.Fatalf("expected exported session key %x, got %x", nlmpRandomSessionKey, sessionKey)
+	}
+
+	// MS-NLMP 4.2.4.4
+	session, err := NewClientSession(b, sessionKey)
+	if err != nil {
+		t.Fatalf("error creating session: %s", err)
+	}
+	sealed, signature, err := session.Seal(nlmpPlaintext)
+	if err != nil {
+		t.Fatalf("error sealing message: %s", err)
+	}
+	if expected := unhex("54e50165bf1936dc996020c1811b0f06fb5f"); !bytes.Equal(sealed, expected) {
+		t.Fatalf("expected sealed data %x, got %x", expected, sealed)
+	}
+	if expected := unhex("010000007fb38ec5c55d497600000000"); !bytes.Equal(signature, expected) {
+		t.Fatalf("expected signature %x, got %x", expected, signature)
+	}
+}
+
+// nlmpClientVersion is the version of the client of MS-NLMP 4.2
+var nlmpClientVersion = Version{ProductMajorVersion: 5, ProductMinorVersion: 1, ProductBuild: 2600, NTLMRevisionCurrent: 15}
+
+func TestMSNLMPAuthenticateMessages(t *testing.T) {
+	// the payload of the messages starts with the domain, user and workstation
+	names := "44006f006d00610069006e00" + "5500730065007200" + "43004f004d0050005500540045005200"
+	for _, table := range []struct {
+		name string
+		// the flags of the AUTHENTICATE message, the ones of the CHALLENGE
+		// message of the specification only differ in bits the responses do
+		// not depend on
+		flags      NegotiateFlags
+		targetInfo []byte
+		ntlmv1     bool
+		expected   string
+	}{
+		{"4.2.2.3", 0xe2808235, nil, true, "4e544c4d535350000300000018001800" +
+			"6c00000018001800840000000c000c00" + "48000000080008005400000010001000" +
+			"5c000000100010009c000000" + "358280e2" + "0501280a0000000f" + names +
+			"98def7b87f88aa5dafe2df779688a172def11c7d5ccdef13" +
+			"67c43011f30298a2ad35ece64f16331c44bdbed927841f94" +
+			"518822b1b3f350c8958682ecbb3e3cb7"},
+		{"4.2.3.3", 0x82088235, nil, true, "4e544c4d535350000300000018001800" +
+			"6c00000018001800840000000c000c00" + "48000000080008005400000010001000" +
+			"5c000000000000009c000000" + "35820882" + "0501280a0000000f" + names +
+			"aaaaaaaaaaaaaaaa00000000000000000000000000000000" +
+			"7537f803ae367128ca458204bde7caf81e97ed2683267232"},
+		{"4.2.4.3", 0xe2888235, nlmpTargetInfo, false, "4e544c4d535350000300000018001800" +
+			"6c00000054005400840000000c000c00" + "48000000080008005400000010001000" +
+			"5c00000010001000d8000000" + "358288e2" + "0501280a0000000f" + names +
+			"86c35097ac9cec102554764a57cccc19aaaaaaaaaaaaaaaa" +
+			"68cd0ab851e51c96aabc927bebef6a1c" + "0101000000000000" + "0000000000000000" + "aaaaaaaaaaaaaaaa" + "00000000" +
+			"02000c0044006f006d00610069006e0001000c005300650072007600650072000000000000000000" +
+			"c5dad2544fc9799094ce1ce90bc9d03e"},
+	} {
+		b, _, err := ProcessChallengeWithOptions(nlmpChallenge(t, table.flags, table.targetInfo), nlmpUser, nlmpPassword, true,
+			nlmpOptions(ChallengeOptions{InsecureNTLMv1: table.ntlmv1, Version: &nlmpClientVersion}))
+		if err != nil {
+			t.Fatalf("%s: error processing challenge: %s", table.name, err)
+		}
+		if expected := unhex(table.expected); !bytes.Equal(b, expected) {
+			t.Fatalf("%s: expected authenticate message %x, got %x", table.name, expected, b)
+		}
+	}
+}
@@ -1,9 +1,13 @@
 package ntlmssp
 
-type negotiateFlags uint32
+import "strings"
+
+// NegotiateFlags is the set of NTLMSSP_NEGOTIATE flags exchanged in NTLM messages,
+// see https://msdn.microsoft.com/en-us/library/cc236650.aspx
+type NegotiateFlags uint32
 
 const (
-	/*A*/ negotiateFlagNTLMSSPNEGOTIATEUNICODE negotiateFlags = 1 << 0
+	/*A*/ negotiateFlagNTLMSSPNEGOTIATEUNICODE NegotiateFlags = 1 << 0
 	/*B*/ negotiateFlagNTLMNEGOTIATEOEM = 1 << 1
 	/*C*/ negotiateFlagNTLMSSPREQUESTTARGET = 1 << 2
 
@@ -43,10 +47,120 @@ const (
 	/*W*/ negotiateFlagNTLMSSPNEGOTIATE56 = 1 << 31
 )
 
-func (field negotiateFlags) Has(flags negotiateFlags) bool {
+// NegotiateFlags bits, named after MS-NLMP 2.2.2.5
+const (
+	// NegotiateFlagUnicode is NTLMSSP_NEGOTIATE_UNICODE, Unicode strings
+	NegotiateFlagUnicode NegotiateFlags = negotiateFlagNTLMSSPNEGOTIATEUNICODE
+
+	// NegotiateFlagOEM is NTLM_NEGOTIATE_OEM, OEM strings
+	NegotiateFlagOEM NegotiateFlags = negotiateFlagNTLMNEGOTIATEOEM
+
+	// NegotiateFlagRequestTarget is NTLMSSP_REQUEST_TARGET, the TargetName is requested
+	NegotiateFlagRequestTarget NegotiateFlags = negotiateFlagNTLMSSPREQUESTTARGET
+
+	// NegotiateFlagSign is NTLMSSP_NEGOTIATE_SIGN, message integrity
+	NegotiateFlagSign NegotiateFlags = negotiateFlagNTLMSSPNEGOTIATESIGN
+
+	// NegotiateFlagSeal is NTLMSSP_NEGOTIATE_SEAL, message confidentiality
+	NegotiateFlagSeal NegotiateFlags = negotiateFlagNTLMSSPNEGOTIATESEAL
+
+	// NegotiateFlagDatagram is NTLMSSP_NEGOTIATE_DATAGRAM, connectionless authentication
+	NegotiateFlagDatagram NegotiateFlags = negotiateFlagNTLMSSPNEGOTIATEDATAGRAM
+
+	// NegotiateFlagLMKey is NTLMSSP_NEGOTIATE_LM_KEY, LAN Manager session keys
+	NegotiateFlagLMKey NegotiateFlags = negotiateFlagNTLMSSPNEGOTIATELMKEY
+
+	// NegotiateFlagNTLM is NTLMSSP_NEGOTIATE_NTLM, NTLMv1 session security
+	NegotiateFlagNTLM NegotiateFlags = negotiateFlagNTLMSSPNEGOTIATENTLM
+
+	// NegotiateFlagAnonymous is NTLMSSP_ANONYMOUS, an anonymous connection
+	NegotiateFlagAnonymous NegotiateFlags = negotiateFlagANONYMOUS
+
+	// NegotiateFlagOEMDomainSupplied is NTLMSSP_NEGOTIATE_OEM_DOMAIN_SUPPLIED, the NEGOTIATE message has a domain name
+	NegotiateFlagOEMDomainSupplied NegotiateFlags = negotiateFlagNTLMSSPNEGOTIATEOEMDOMAINSUPPLIED
+
+	// NegotiateFlagOEMWorkstationSupplied is NTLMSSP_NEGOTIATE_OEM_WORKSTATION_SUPPLIED, the NEGOTIATE message has a workstation name
+	NegotiateFlagOEMWorkstationSupplied NegotiateFlags = negotiateFlagNTLMSSPNEGOTIATEOEMWORKSTATIONSUPPLIED
+
+	// NegotiateFlagAlwaysSign is NTLMSSP_NEGOTIATE_ALWAYS_SIGN, signatures even without integrity
+	NegotiateFlagAlwaysSign NegotiateFlags = negotiateFlagNTLMSSPNEGOTIATEALWAYSSIGN
+
+	// NegotiateFlagTargetTypeDomain is NTLMSSP_TARGET_TYPE_DOMAIN, the TargetName is a domain name
+	NegotiateFlagTargetTypeDomain NegotiateFlags = negotiateFlagNTLMSSPTARGETTYPEDOMAIN
+
+	// NegotiateFlagTargetTypeServer is NTLMSSP_TARGET_TYPE_SERVER, the TargetName is a server name
+	NegotiateFlagTargetTypeServer NegotiateFlags = negotiateFlagNTLMSSPTARGETTYPESERVER
+
+	// NegotiateFlagExtendedSessionSecurity is NTLMSSP_NEGOTIATE_EXTENDED_SESSIONSECURITY, NTLM2 session security
+	NegotiateFlagExtendedSessionSecurity NegotiateFlags = negotiateFlagNTLMSSPNEGOTIATEEXTENDEDSESSIONSECURITY
+
+	// NegotiateFlagIdentify is NTLMSSP_NEGOTIATE_IDENTIFY, an identify level token
+	NegotiateFlagIdentify NegotiateFlags = negotiateFlagNTLMSSPNEGOTIATEIDENTIFY
+
+	// NegotiateFlagRequestNonNTSessionKey is NTLMSSP_REQUEST_NON_NT_SESSION_KEY, the LMOWF session key
+	NegotiateFlagRequestNonNTSessionKey NegotiateFlags = negotiateFlagNTLMSSPREQUESTNONNTSESSIONKEY
+
+	// NegotiateFlagTargetInfo is NTLMSSP_NEGOTIATE_TARGET_INFO, the CHALLENGE message has a target info
+	NegotiateFlagTargetInfo NegotiateFlags = negotiateFlagNTLMSSPNEGOTIATETARGETINFO
+
+	// NegotiateFlagVersion is NTLMSSP_NEGOTIATE_VERSION, the messages carry a Version
+	NegotiateFlagVersion NegotiateFlags = negotiateFlagNTLMSSPNEGOTIATEVERSION
+
+	// NegotiateFlag128 is NTLMSSP_NEGOTIATE_128, 128-bit session keys
+	NegotiateFlag128 NegotiateFlags = negotiateFlagNTLMSSPNEGOTIATE128
+
+	// NegotiateFlagKeyExch is NTLMSSP_NEGOTIATE_KEY_EXCH, an exchanged random session key
+	NegotiateFlagKeyExch NegotiateFlags = negotiateFlagNTLMSSPNEGOTIATEKEYEXCH
+
+	// NegotiateFlag56 is NTLMSSP_NEGOTIATE_56, 56-bit session keys
+	NegotiateFlag56 NegotiateFlags = negotiateFlagNTLMSSPNEGOTIATE56
+)
+
+// Has reports whether all the bits of flags are set.
+func (field NegotiateFlags) Has(flags NegotiateFlags) bool {
 	return field&flags == flags
 }
 
-func (field *negotiateFlags) Unset(flags negotiateFlags) {
+// Unset clears the bits of flags.
+func (field *NegotiateFlags) Unset(flags NegotiateFlags) {
 	*field = *field ^ (*field & flags)
 }
+
+var negotiateFlagNames = []struct {
+	flag NegotiateFlags
+	name string
+}{
+	{negotiateFlagNTLMSSPNEGOTIATEUNICODE, "NTLMSSP_NEGOTIATE_UNICODE"},
+	{negotiateFlagNTLMNEGOTIATEOEM, "NTLM_NEGOTIATE_OEM"},
+	{negotiateFlagNTLMSSPREQUESTTARGET, "NTLMSSP_REQUEST_TARGET"},
+	{negotiateFlagNTLMSSPNEGOTIATESIGN, "NTLMSSP_NEGOTIATE_SIGN"},
+	{negotiateFlagNTLMSSPNEGOTIATESEAL, "NTLMSSP_NEGOTIATE_SEAL"},
+	{negotiateFlagNTLMSSPNEGOTIATEDATAGRAM, "NTLMSSP_NEGOTIATE_DATAGRAM"},
+	{negotiateFlagNTLMSSPNEGOTIATELMKEY, "NTLMSSP_NEGOTIATE_LM_KEY"},
+	{negotiateFlagNTLMSSPNEGOTIATENTLM, "NTLMSSP_NEGOTIATE_NTLM"},
+	{negotiateFlagANONYMOUS, "NTLMSSP_ANONYMOUS"},
+	{negotiateFlagNTLMSSPNEGOTIATEOEMDOMAINSUPPLIED, "NTLMSSP_NEGOTIATE_OEM_DOMAIN_SUPPLIED"},
+	{negotiateFlagNTLMSSPNEGOTIATEOEMWORKSTATIONSUPPLIED, "NTLMSSP_NEGOTIATE_OEM_WORKSTATION_SUPPLIED"},
+	{negotiateFlagNTLMSSPNEGOTIATEALWAYSSIGN, "NTLMSSP_NEGOTIATE_ALWAYS_SIGN"},
+	{negotiateFlagNTLMSSPTARGETTYPEDOMAIN, "NTLMSSP_TARGET_TYPE_DOMAIN"},
+	{negotiateFlagNTLMSSPTARGETTYPESERVER, "NTLMSSP_TARGET_TYPE_SERVER"},
+	{negotiateFlagNTLMSSPNEGOTIATEEXTENDEDSESSIONSECURITY, "NTLMSSP_NEGOTIATE_EXTENDED_SESSIONSECURITY"},
+	{negotiateFlagNTLMSSPNEGOTIATEIDENTIFY, "NTLMSSP_NEGOTIATE_IDENTIFY"},
+	{negotiateFlagNTLMSSPREQUESTNONNTSESSIONKEY, "NTLMSSP_REQUEST_NON_NT_SESSION_KEY"},
+	{negotiateFlagNTLMSSPNEGOTIATETARGETINFO, "NTLMSSP_NEGOTIATE_TARGET_INFO"},
+	{negotiateFlagNTLMSSPNEGOTIATEVERSION, "NTLMSSP_NEGOTIATE_VERSION"},
+	{negotiateFlagNTLMSSPNEGOTIATE128, "NTLMSSP_NEGOTIATE_128"},
+	{negotiateFlagNTLMSSPNEGOTIATEKEYEXCH, "NTLMSSP_NEGOTIATE_KEY_EXCH"},
+	{negotiateFlagNTLMSSPNEGOTIATE56, "NTLMSSP_NEGOTIATE_56"},
+}
+
+// String returns the MS-NLMP names of the flags that are set, separated by '|'.
+func (field NegotiateFlags) String() string {
+	var names []string
+	for _, f := range negotiateFlagNames {
+		if field.Has(f.flag) {
+			names = append(names, f.name)
+		}
+	}
+	return strings.Join(names, "|")
+}
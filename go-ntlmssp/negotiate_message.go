@@ -4,7 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
-	"log"
+	"fmt"
 	"strings"
 )
 
@@ -12,7 +12,7 @@ const expMsgBodyLen = 40
 
 type negotiateMessageFields struct {
 	messageHeader
-	NegotiateFlags negotiateFlags
+	NegotiateFlags NegotiateFlags
 
 	Domain      varField
 	Workstation varField
@@ -20,49 +20,172 @@ type negotiateMessageFields struct {
 	Version
 }
 
-var defaultFlags = negotiateFlagNTLMSSPNEGOTIATETARGETINFO |
-	negotiateFlagNTLMSSPNEGOTIATE56 |
-	negotiateFlagNTLMSSPNEGOTIATE128 |
-	negotiateFlagNTLMSSPNEGOTIATEUNICODE |
-	negotiateFlagNTLMSSPNEGOTIATEEXTENDEDSESSIONSECURITY
+// NegotiateMessage is a NEGOTIATE (Type 1) message, the first message sent by
+// the client, see https://msdn.microsoft.com/en-us/library/cc236641.aspx
+type NegotiateMessage struct {
+	NegotiateFlags NegotiateFlags
 
-// NewNegotiateMessage creates a new NEGOTIATE message with the
-// flags that this package supports.
-func NewNegotiateMessage(domainName, workstationName string) ([]byte, error) {
+	// DomainName and Workstation are OEM encoded with CodePage when it is
+	// set, otherwise their bytes are sent as is
+	DomainName  string
+	Workstation string
+	CodePage    *CodePage
+
+	// Version is written as zeros when not set
+	Version *Version
+}
+
+// MarshalBinary encodes the message. The NTLMSSP_NEGOTIATE_OEM_DOMAIN_SUPPLIED and
+// NTLMSSP_NEGOTIATE_OEM_WORKSTATION_SUPPLIED flags are set for non-empty names.
+func (m NegotiateMessage) MarshalBinary() ([]byte, error) {
 	payloadOffset := expMsgBodyLen
-	flags := defaultFlags
+	flags := m.NegotiateFlags
 
-	if domainName != "" {
+	if m.DomainName != "" {
 		flags |= negotiateFlagNTLMSSPNEGOTIATEOEMDOMAINSUPPLIED
 	}
 
-	if workstationName != "" {
+	if m.Workstation != "" {
 		flags |= negotiateFlagNTLMSSPNEGOTIATEOEMWORKSTATIONSUPPLIED
 	}
 
+	domain, workstation := []byte(m.DomainName), []byte(m.Workstation)
+	if m.CodePage != nil {
+		var err error
+		if domain, err = m.CodePage.encodeString(m.DomainName); err != nil {
+			return nil, err
+		}
+		if workstation, err = m.CodePage.encodeString(m.Workstation); err != nil {
+			return nil, err
+		}
+	}
+
 	msg := negotiateMessageFields{
 		messageHeader:  newMessageHeader(1),
 		NegotiateFlags: flags,
-		Domain:         newVarField(&payloadOffset, len(domainName)),
-		Workstation:    newVarField(&payloadOffset, len(workstationName)),
-		Version:        DefaultVersion(),
+		Domain:         newVarField(&payloadOffset, len(domain)),
+		Workstation:    newVarField(&payloadOffset, len(workstation)),
+	}
+	if m.Version != nil {
+		msg.Version = *m.Version
 	}
 
 	b := bytes.Buffer{}
 	if err := binary.Write(&b, binary.LittleEndian, &msg); err != nil {
-		log.Printf("[DEBUG]%s error writing message in buffer: %s", CallerInfo(), err.Error())
+		logger().Debug("error writing message in buffer", "error", err)
 		return nil, err
 	}
 	if b.Len() != expMsgBodyLen {
-		log.Printf("[DEBUG]%s incorrect body length", CallerInfo())
+		logger().Debug("incorrect body length")
 		return nil, errors.New("incorrect body length")
 	}
 
-	payload := strings.ToUpper(domainName + workstationName)
-	if _, err := b.WriteString(payload); err != nil {
-		log.Printf("[DEBUG]%s error writing payload: %s", CallerInfo(), err.Error())
+	b.Write(domain)
+	if _, err := b.Write(workstation); err != nil {
+		logger().Debug("error writing payload", "error", err)
 		return nil, err
 	}
 
 	return b.Bytes(), nil
 }
+
+// UnmarshalBinary decodes a NEGOTIATE message, with the code page already set
+// in m. Version is set when the message has room for it and it is not all zeros.
+func (m *NegotiateMessage) UnmarshalBinary(data []byte) error {
+	// the version field is optional, pad older messages that omit it
+	fields := data
+	if len(fields) < expMsgBodyLen {
+		fields = make([]byte, expMsgBodyLen)
+		copy(fields, data)
+	}
+	if len(data) < expMsgBodyLen-binary.Size(Version{}) {
+		logger().Debug("negotiate message too short")
+		return fmt.Errorf("%w: negotiate message too short", ErrInvalidMessage)
+	}
+	var f negotiateMessageFields
+	err := binary.Read(bytes.NewReader(fields), binary.LittleEndian, &f)
+	if err != nil {
+		logger().Debug("error reading negotiate message fields", "error", err)
+		return err
+	}
+	if !f.messageHeader.IsValid() || f.MessageType != 1 {
+		logger().Debug("message is not a valid negotiate message", "signature", string(f.Signature[:]), "type", f.MessageType)
+		return fmt.Errorf("%w: not a negotiate message (type %d)", ErrInvalidMessage, f.MessageType)
+	}
+	*m = NegotiateMessage{NegotiateFlags: f.NegotiateFlags, CodePage: m.CodePage}
+
+	if payloadOffset(data, f.Domain, f.Workstation) >= expMsgBodyLen && f.Version != (Version{}) {
+		version := f.Version
+		m.Version = &version
+	}
+
+	if m.NegotiateFlags.Has(negotiateFlagNTLMSSPNEGOTIATEOEMDOMAINSUPPLIED) {
+		m.DomainName, err = f.Domain.ReadStringFrom(data, false, m.CodePage)
+		if err != nil {
+			logger().Debug("error reading domain name", "error", err)
+			return err
+		}
+	}
+	if m.NegotiateFlags.Has(negotiateFlagNTLMSSPNEGOTIATEOEMWORKSTATIONSUPPLIED) {
+		m.Workstation, err = f.Workstation.ReadStringFrom(data, false, m.CodePage)
+		if err != nil {
+			logger().Debug("error reading workstation", "error", err)
+			return err
+		}
+	}
+	return nil
+}
+
+var defaultFlags = negotiateFlagNTLMSSPNEGOTIATETARGETINFO |
+	negotiateFlagNTLMSSPNEGOTIATE56 |
+	negotiateFlagNTLMSSPNEGOTIATE128 |
+	negotiateFlagNTLMSSPNEGOTIATEUNICODE |
+	negotiateFlagNTLMSSPNEGOTIATEEXTENDEDSESSIONSECURITY
+
+var sessionFlags NegotiateFlags = negotiateFlagNTLMSSPNEGOTIATESIGN |
+	negotiateFlagNTLMSSPNEGOTIATESEAL |
+	negotiateFlagNTLMSSPNEGOTIATEALWAYSSIGN |
+	negotiateFlagNTLMSSPNEGOTIATEKEYEXCH
+
+// NewNegotiateMessage creates a new NEGOTIATE message with the
+// flags that this package supports.
+func NewNegotiateMessage(domainName, workstationName string) ([]byte, error) {
+	return newNegotiateMessage(domainName, workstationName, defaultFlags, nil, nil)
+}
+
+// NewSessionNegotiateMessage creates a new NEGOTIATE message that additionally
+// requests signing, sealing and key exchange, for use with a Session.
+func NewSessionNegotiateMessage(domainName, workstationName string) ([]byte, error) {
+	return newNegotiateMessage(domainName, workstationName, defaultFlags|sessionFlags, nil, nil)
+}
+
+// newNegotiateMessage creates a NEGOTIATE message, also offering OEM
+// encoding when cp is set. The names are optional, those cp cannot encode are
+// left out. The version is DefaultVersion() if v is nil, otherwise v is
+// announced with NTLMSSP_NEGOTIATE_VERSION.
+func newNegotiateMessage(domainName, workstationName string, flags NegotiateFlags, cp *CodePage, v *Version) ([]byte, error) {
+	domainName, workstationName = strings.ToUpper(domainName), strings.ToUpper(workstationName)
+	if cp != nil {
+		flags |= negotiateFlagNTLMNEGOTIATEOEM
+		if _, err := cp.encodeString(domainName); err != nil {
+			logger().Debug("domain name left out of negotiate message", "error", err)
+			domainName = ""
+		}
+		if _, err := cp.encodeString(workstationName); err != nil {
+			logger().Debug("workstation left out of negotiate message", "error", err)
+			workstationName = ""
+		}
+	}
+	version := DefaultVersion()
+	if v != nil {
+		version = *v
+		flags |= negotiateFlagNTLMSSPNEGOTIATEVERSION
+	}
+	return NegotiateMessage{
+		NegotiateFlags: flags,
+		DomainName:     domainName,
+		Workstation:    workstationName,
+		CodePage:       cp,
+		Version:        &version,
+	}.MarshalBinary()
+}
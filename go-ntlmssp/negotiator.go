@@ -1,11 +1,9 @@
 package ntlmssp
 
 import (
-	"bytes"
-	"encoding/base64"
 	"io"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
 	"strings"
 )
@@ -29,9 +27,93 @@ func GetDomain(user string) (string, string, bool) {
 	return user, domain, domainNeeded
 }
 
+// Credentials are the secrets a CredentialProvider supplies for NTLM authentication.
+type Credentials struct {
+	// User is the account name, optionally qualified as DOMAIN\user or user@domain
+	User     string
+	Password string
+
+	// Hash is the hex encoded NT hash of the password, optionally in the LM:NT form.
+	// When set, it is used instead of Password.
+	Hash string
+
+	// Domain is the domain of the user, sent in the NEGOTIATE and AUTHENTICATE
+	// messages. It is parsed from User when empty
+	Domain string
+
+	// Workstation is the name of the client machine, sent in the NEGOTIATE
+	// and AUTHENTICATE messages
+	Workstation string
+
+	// Anonymous authenticates as the anonymous user (null session), for
+	// servers that permit it. User, Password, Hash and Domain are ignored.
+	Anonymous bool
+}
+
+// CredentialProvider supplies the credentials used to answer an NTLM challenge
+// for a request. Returning nil credentials and no error leaves the request
+// unauthenticated.
+type CredentialProvider interface {
+	Credentials(req *http.Request) (*Credentials, error)
+}
+
+// CredentialProviderFunc is an adapter to allow the use of ordinary functions as
+// a CredentialProvider.
+type CredentialProviderFunc func(req *http.Request) (*Credentials, error)
+
+// Credentials calls f(req).
+func (f CredentialProviderFunc) Credentials(req *http.Request) (*Credentials, error) {
+	return f(req)
+}
+
 // Negotiator is a http.Roundtripper decorator that automatically
 // converts basic authentication to NTLM/Negotiate authentication when appropriate.
-type Negotiator struct{ http.RoundTripper }
+//
+// When Credentials is set, the Basic authentication header is not used: requests
+// are sent as they are, and credentials are requested from the provider only
+// when the server asks for NTLM/Negotiate authentication. They are never sent
+// outside of NTLM messages.
+//
+// ProxyCredentials likewise answers NTLM/Negotiate challenges from a proxy
+// (407 Proxy Authentication Required) for plain HTTP requests. HTTPS requests
+// are tunneled with CONNECT by the transport, use a ProxyDialer for those.
+//
+// NTLM authenticates a connection, so the legs of a handshake must share one.
+// When RoundTripper is a *http.Transport, the handshake is sent through a copy
+// of it holding a single HTTP/1.1 connection per host. Other round trippers are
+// used as they are, and the handshake fails if they switch connections or use HTTP/2.
+type Negotiator struct {
+	http.RoundTripper
+
+	Credentials      CredentialProvider
+	ProxyCredentials CredentialProvider
+
+	// EmptyBodyProbe, when set, sends the anonymous try and the NEGOTIATE
+	// message as HEAD requests, so the request body is only sent once, with
+	// the AUTHENTICATE message. It is ignored when ProxyCredentials is set.
+	// Without it, the body is read again from req.GetBody for each leg, and
+	// buffered if GetBody is not set.
+	EmptyBodyProbe bool
+
+	// Logger receives the debug output of the handshakes, the package logger
+	// is used if nil
+	Logger *slog.Logger
+
+	// Mechanisms are the security mechanisms offered with the Negotiate
+	// scheme, in order of preference, NTLMMechanism only if empty. A mechanism
+	// that cannot start a context, such as Kerberos without a ticket, is
+	// skipped. The NTLM scheme uses the NTLM mechanism of the list.
+	Mechanisms []Mechanism
+
+	// Workstation is sent with the credentials of the Basic authentication
+	// header, the provided Credentials carry their own
+	Workstation string
+
+	// Cache, when set, remembers the hosts asking for authentication and the
+	// authenticated connections, to skip anonymous tries and handshakes. When
+	// nil, the connection of a handshake is closed with the response body.
+	Cache *HandshakeCache
+}
 
 // RoundTrip sends the request to the server, handling any authentication
 // re-sends as needed.
@@ -41,34 +123,38 @@ func (l Negotiator) RoundTrip(req *http.Request) (res *http.Response, err error)
 	if rt == nil {
 		rt = http.DefaultTransport
 	}
+	l.Logger = loggerOr(l.Logger).With("host", req.URL.Host)
+	if l.Credentials != nil || l.ProxyCredentials != nil {
+		return l.roundTripWithProvider(rt, req)
+	}
 	// If it is not basic auth, just round trip the request as usual
 	reqauth := authheader(req.Header.Values("Authorization"))
 	if !reqauth.IsBasic() {
 		return rt.RoundTrip(req)
 	}
 	reqauthBasic := reqauth.Basic()
-	// Save request body
-	body := bytes.Buffer{}
-	if req.Body != nil {
-		_, err = body.ReadFrom(req.Body)
+	body, err := newRequestBody(req, l.EmptyBodyProbe, l.Logger)
+	if err != nil {
+		return nil, err
+	}
+	// first try anonymous, unless the host is known to ask for
+	// authentication, to find out which scheme it asks for
+	req.Header.Del("Authorization")
+	if resauth, ok := l.Cache.host(req.URL); ok {
+		u, p, err := reqauth.GetBasicCreds()
 		if err != nil {
-			log.Printf("[DEBUG]%s error reading req body: %s", CallerInfo(), err.Error())
+			l.Logger.Debug("error getting basic credentials", "error", err)
 			return nil, err
 		}
-
-		req.Body.Close()
-		req.Body = ioutil.NopCloser(bytes.NewReader(body.Bytes()))
+		return l.roundTripKnownHost(rt, req, body, resauth, &Credentials{User: u, Password: p, Workstation: l.Workstation})
 	}
-	// first try anonymous, in case the server still finds us
-	// authenticated from previous traffic
-	req.Header.Del("Authorization")
-	res, err = rt.RoundTrip(req)
+	res, err = body.probeOrSend(rt, req)
 	if err != nil {
-		log.Printf("[DEBUG]%s error in anonymous try: %s", CallerInfo(), err.Error())
+		l.Logger.Debug("error in anonymous try", "stage", "anonymous", "error", err)
 		return nil, err
 	}
 	if res.StatusCode != http.StatusUnauthorized {
-		log.Printf("[DEBUG]%s res status code in anonymous try is not http unauthorized: %s", CallerInfo(), err.Error())
+		l.Logger.Debug("no authentication requested", "stage", "anonymous", "status", res.StatusCode)
 		return res, err
 	}
 	resauth := authheader(res.Header.Values("Www-Authenticate"))
@@ -77,15 +163,14 @@ func (l Negotiator) RoundTrip(req *http.Request) (res *http.Response, err error)
 		req.Header.Set("Authorization", string(reqauthBasic))
 		io.Copy(ioutil.Discard, res.Body)
 		res.Body.Close()
-		req.Body = ioutil.NopCloser(bytes.NewReader(body.Bytes()))
 
-		res, err = rt.RoundTrip(req)
+		res, err = body.probeOrSend(rt, req)
 		if err != nil {
-			log.Printf("[DEBUG]%s error in basic authentication try: %s", CallerInfo(), err.Error())
+			l.Logger.Debug("error in basic authentication try", "stage", "basic", "error", err)
 			return nil, err
 		}
 		if res.StatusCode != http.StatusUnauthorized {
-			log.Printf("[DEBUG]%s res status code in basic authentication try is not http unauthorized: %s", CallerInfo(), err.Error())
+			l.Logger.Debug("basic authentication accepted", "stage", "basic", "status", res.StatusCode)
 			return res, err
 		}
 		resauth = authheader(res.Header.Values("Www-Authenticate"))
@@ -99,65 +184,240 @@ func (l Negotiator) RoundTrip(req *http.Request) (res *http.Response, err error)
 		// recycle credentials
 		u, p, err := reqauth.GetBasicCreds()
 		if err != nil {
-			log.Printf("[DEBUG]%s error getting basic credentials: %s", CallerInfo(), err.Error())
+			l.Logger.Debug("error getting basic credentials", "error", err)
 			return nil, err
 		}
 
-		// get domain from username
-		domain := ""
-		u, domain, domainNeeded := GetDomain(u)
+		return l.handshake(newHandshakeConn(rt), req, body, resauth, &Credentials{User: u, Password: p, Workstation: l.Workstation})
+	}
+
+	return res, err
+}
 
-		// send negotiate
-		negotiateMessage, err := NewNegotiateMessage(domain, "")
+// roundTripWithProvider sends the request as is, and authenticates with the
+// credentials from l.ProxyCredentials and l.Credentials if the proxy or the
+// server ask for it.
+func (l Negotiator) roundTripWithProvider(rt http.RoundTripper, req *http.Request) (*http.Response, error) {
+	// the body is sent on each proxy leg, it cannot be probed for
+	body, err := newRequestBody(req, l.EmptyBodyProbe && l.ProxyCredentials == nil, l.Logger)
+	if err != nil {
+		return nil, err
+	}
+	if resauth, ok := l.Cache.host(req.URL); ok && l.Credentials != nil && l.ProxyCredentials == nil {
+		creds, err := l.Credentials.Credentials(req)
 		if err != nil {
-			log.Printf("[DEBUG]%s error creating negotiation message: %s", CallerInfo(), err.Error())
+			l.Logger.Debug("error getting credentials", "error", err)
 			return nil, err
 		}
-		if resauth.IsNTLM() {
-			req.Header.Set("Authorization", "NTLM "+base64.StdEncoding.EncodeToString(negotiateMessage))
-		} else {
-			req.Header.Set("Authorization", "Negotiate "+base64.StdEncoding.EncodeToString(negotiateMessage))
+		if creds != nil {
+			return l.roundTripKnownHost(rt, req, body, resauth, creds)
 		}
+	}
+	res, err := body.probeOrSend(rt, req)
+	if err != nil {
+		l.Logger.Debug("error in anonymous try", "stage", "anonymous", "error", err)
+		return nil, err
+	}
 
-		req.Body = ioutil.NopCloser(bytes.NewReader(body.Bytes()))
+	// the handshakes, proxy first, share a connection
+	var conn *handshakeConn
+	for _, step := range []struct {
+		scheme      authScheme
+		credentials CredentialProvider
+	}{
+		{proxyAuthScheme, l.ProxyCredentials},
+		{serverAuthScheme, l.Credentials},
+	} {
+		if step.credentials == nil || !step.scheme.challenged(res) {
+			continue
+		}
+		creds, err := step.credentials.Credentials(req)
+		if err != nil {
+			l.Logger.Debug("error getting credentials", "error", err)
+			res.Body.Close()
+			conn.Close()
+			return nil, err
+		}
+		if creds == nil {
+			l.Logger.Debug("no credentials for request, letting client deal with response", "stage", step.scheme.stage())
+			break
+		}
+		io.Copy(ioutil.Discard, res.Body)
+		res.Body.Close()
 
-		res, err = rt.RoundTrip(req)
+		resauth := authheader(res.Header.Values(step.scheme.challengeHeader))
+		if step.scheme == serverAuthScheme && l.ProxyCredentials == nil {
+			return l.handshake(newHandshakeConn(rt), req, body, resauth, creds)
+		}
+		if conn == nil {
+			conn = newHandshakeConn(rt)
+		}
+		res, err = l.authenticate(conn, req, body, step.scheme, resauth, creds)
 		if err != nil {
-			log.Printf("[DEBUG]%s error sending negotiation: %s", CallerInfo(), err.Error())
+			conn.Close()
 			return nil, err
 		}
+		// the proxy authenticates the connection, not each request
+		req.Header.Del(proxyAuthScheme.authorizationHeader)
+	}
+	if conn != nil {
+		res.Body = &releaseOnClose{ReadCloser: res.Body, release: conn.Close}
+	}
+	return res, nil
+}
+
+// roundTripKnownHost sends req to a host known to ask for authentication, on
+// an idle connection authenticated with creds if the cache has one, otherwise
+// starting the handshake right away.
+func (l Negotiator) roundTripKnownHost(rt http.RoundTripper, req *http.Request, body *requestBody, resauth authheader, creds *Credentials) (*http.Response, error) {
+	key := connKey(req.URL, creds)
+	conn := l.Cache.get(key)
+	if conn == nil {
+		l.Cache.countProbeSkipped()
+		return l.handshake(newHandshakeConn(rt), req, body, resauth, creds)
+	}
+
+	res, err := body.send(conn, req)
+	if err != nil {
+		l.Logger.Debug("error on authenticated connection", "stage", "reuse", "error", err)
+		conn.Close()
+		return nil, err
+	}
+	if !serverAuthScheme.challenged(res) {
+		l.Cache.countConnectionReused()
+		return l.Cache.keep(key, conn, res), nil
+	}
+
+	// the server no longer finds the connection authenticated
+	l.Logger.Debug("authenticated connection challenged again", "stage", "reuse")
+	if !body.replayable() {
+		l.Logger.Debug("request body cannot be sent again, letting client deal with response", "stage", "reuse")
+		return res, nil
+	}
+	io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+	resauth = authheader(res.Header.Values(serverAuthScheme.challengeHeader))
+	return l.handshake(conn, req, body, resauth, creds)
+}
+
+// handshake authenticates req with the server on conn. When it succeeds, conn
+// is kept in the cache once the response body is closed, it is closed otherwise.
+func (l Negotiator) handshake(conn *handshakeConn, req *http.Request, body *requestBody, resauth authheader, creds *Credentials) (*http.Response, error) {
+	l.Cache.setHost(req.URL, resauth)
+	l.Cache.countHandshake()
+	res, err := l.authenticate(conn, req, body, serverAuthScheme, resauth, creds)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if res.StatusCode == http.StatusUnauthorized {
+		l.Logger.Debug("authentication rejected", "stage", "server", "status", res.StatusCode)
+		res.Body = &releaseOnClose{ReadCloser: res.Body, release: conn.Close}
+		return res, nil
+	}
+	l.Logger.Debug("authenticated", "stage", "server", "status", res.StatusCode)
+	return l.Cache.keep(connKey(req.URL, creds), conn, res), nil
+}
+
+// maxLegs bounds the number of requests of a handshake
+const maxLegs = 5
+
+// authenticate performs the handshake after the server (or proxy) answered
+// with a NTLM or Negotiate challenge, and sends the request with the last token.
+// All legs must be sent on the same connection, an error is returned otherwise.
+func (l Negotiator) authenticate(rt http.RoundTripper, req *http.Request, body *requestBody, scheme authScheme, resauth authheader, creds *Credentials) (*http.Response, error) {
+	h := newClientHandshake(l.Mechanisms, l.target(scheme, req), creds, l.Logger)
+	tracker := &connTracker{logger: l.Logger}
+	req = tracker.withTrace(req)
+
+	// send negotiate
+	token, err := h.negotiateToken(resauth)
+	if err != nil {
+		return nil, handshakeError(StageNegotiate, 0, 0, err)
+	}
+	stage := StageNegotiate
+	for leg := 1; ; leg++ {
+		scheme.setAuthorization(req.Header, resauth, token)
+		var res *http.Response
+		if h.complete {
+			res, err = body.send(rt, req)
+		} else {
+			res, err = body.probeOrSend(rt, req)
+		}
+		if err != nil {
+			l.Logger.Debug("error sending token", "stage", scheme.stage(), "leg", leg, "error", err)
+			return nil, handshakeError(stage, h.flags(), 0, err)
+		}
+		if err := tracker.check(res); err != nil {
+			res.Body.Close()
+			return nil, handshakeError(stage, h.flags(), res.StatusCode, err)
+		}
+
+		if res.StatusCode != scheme.status {
+			// the last token of the server, with its mechListMIC
+			token, err := authheader(res.Header.Values(scheme.challengeHeader)).GetData()
+			if err == nil {
+				err = h.verify(token)
+			}
+			if err != nil {
+				res.Body.Close()
+				return nil, handshakeError(stage, h.flags(), res.StatusCode, err)
+			}
+			return res, nil
+		}
+		if h.complete {
+			return res, nil
+		}
 
 		// receive challenge?
-		resauth = authheader(res.Header.Values("Www-Authenticate"))
-		challengeMessage, err := resauth.GetData()
+		resauth = authheader(res.Header.Values(scheme.challengeHeader))
+		challengeToken, err := resauth.GetData()
 		if err != nil {
-			log.Printf("[DEBUG]%s error getting challenge data: %s", CallerInfo(), err.Error())
-			return nil, err
+			l.Logger.Debug("error getting challenge data", "stage", scheme.stage(), "error", err)
+			res.Body.Close()
+			return nil, handshakeError(StageChallenge, h.flags(), res.StatusCode, err)
 		}
-		if !(resauth.IsNegotiate() || resauth.IsNTLM()) || len(challengeMessage) == 0 {
+		if !(resauth.IsNegotiate() || resauth.IsNTLM()) || len(challengeToken) == 0 {
 			// Negotiation failed, let client deal with response
-			log.Printf("[DEBUG]%s negotiation failed, letting client deal with response", CallerInfo())
+			l.Logger.Debug("negotiation failed, letting client deal with response", "stage", scheme.stage(), "status", res.StatusCode)
 			return res, nil
 		}
 		io.Copy(ioutil.Discard, res.Body)
 		res.Body.Close()
-
-		// send authenticate
-		authenticateMessage, err := ProcessChallenge(challengeMessage, u, p, domainNeeded)
-		if err != nil {
-			log.Printf("[DEBUG]%s error processing challenge: %s", CallerInfo(), err.Error())
-			return nil, err
+		if leg == maxLegs {
+			l.Logger.Debug("too many legs in handshake", "stage", scheme.stage())
+			return nil, handshakeError(stage, h.flags(), res.StatusCode, ErrHandshakeIncomplete)
 		}
-		if resauth.IsNTLM() {
-			req.Header.Set("Authorization", "NTLM "+base64.StdEncoding.EncodeToString(authenticateMessage))
-		} else {
-			req.Header.Set("Authorization", "Negotiate "+base64.StdEncoding.EncodeToString(authenticateMessage))
+		if res.Close {
+			l.Logger.Debug("connection closed during the handshake", "stage", scheme.stage())
+			return nil, handshakeError(StageChallenge, tokenFlags(challengeToken), res.StatusCode, ErrConnectionSwitched)
 		}
 
-		req.Body = ioutil.NopCloser(bytes.NewReader(body.Bytes()))
+		// bind to the TLS channel for Extended Protection for Authentication
+		var channelBindings *ChannelBindings
+		if scheme == serverAuthScheme && res.TLS != nil && len(res.TLS.PeerCertificates) > 0 {
+			channelBindings = TLSServerEndPointBindings(res.TLS.PeerCertificates[0])
+		}
 
-		return rt.RoundTrip(req)
+		// send authenticate
+		if token, err = h.nextToken(challengeToken, channelBindings); err != nil {
+			stage = StageChallenge
+			if h.flags() != 0 {
+				stage = StageAuthenticate
+			}
+			return nil, handshakeError(stage, h.flags(), res.StatusCode, err)
+		}
+		stage = StageAuthenticate
 	}
+}
 
-	return res, err
+// target returns the host authenticated by scheme for req, the proxy of the
+// transport for a proxy.
+func (l Negotiator) target(scheme authScheme, req *http.Request) string {
+	if t, ok := l.RoundTripper.(*http.Transport); ok && scheme == proxyAuthScheme && t.Proxy != nil {
+		if u, err := t.Proxy(req); err == nil && u != nil {
+			return u.Hostname()
+		}
+	}
+	return req.URL.Hostname()
 }
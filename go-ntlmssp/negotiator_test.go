@@ -0,0 +1,367 @@
+package ntlmssp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNegotiatorCredentialProvider(t *testing.T) {
+	ntlm := newTestServer().Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.Header.Get("Authorization"), "Basic ") {
+			t.Errorf("credentials sent with basic authentication")
+		}
+		ntlm.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	for _, table := range []struct {
+		creds  *Credentials
+		status int
+	}{
+		{&Credentials{User: username, Password: password, Domain: domain, Workstation: workstation}, http.StatusOK},
+		{&Credentials{User: domain + "\\" + username, Password: password}, http.StatusOK},
+		// the domain of the user is sent, not the one of the server
+		{&Credentials{User: username, Password: password, Domain: "OTHER"}, http.StatusUnauthorized},
+		{&Credentials{User: "OTHER\\" + username, Password: password}, http.StatusUnauthorized},
+		{&Credentials{User: username, Password: "wrong"}, http.StatusUnauthorized},
+		{&Credentials{User: username, Hash: ntlmHashHex}, http.StatusOK},
+		{&Credentials{User: username, Hash: "aad3b435b51404eeaad3b435b51404ee:" + ntlmHashHex}, http.StatusOK},
+		{&Credentials{User: username, Hash: "31d6cfe0d16ae931b73c59d7e0c089c0"}, http.StatusUnauthorized},
+		{nil, http.StatusUnauthorized},
+	} {
+		client := &http.Client{Transport: Negotiator{
+			RoundTripper: &http.Transport{},
+			Credentials: CredentialProviderFunc(func(req *http.Request) (*Credentials, error) {
+				return table.creds, nil
+			}),
+		}}
+		res, err := client.Post(ts.URL, "text/plain", strings.NewReader("body"))
+		if err != nil {
+			t.Fatalf("error sending request: %s", err)
+		}
+		res.Body.Close()
+		if res.StatusCode != table.status {
+			t.Fatalf("expected status %d for %+v, got %d", table.status, table.creds, res.StatusCode)
+		}
+	}
+}
+
+func TestNegotiatorNonLatinDomain(t *testing.T) {
+	server := newTestServer()
+	server.Credentials = CredentialStoreFunc(func(user, userDomain string) ([]byte, error) {
+		if user != username || userDomain != "ДОМЕН" {
+			return nil, errors.New("unknown user")
+		}
+		return getNtlmHash(password), nil
+	})
+	ts := httptest.NewServer(server.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	defer ts.Close()
+
+	for _, mechanisms := range [][]Mechanism{nil, {NTLMMechanism{CodePage: CodePage850}}} {
+		client := &http.Client{Transport: Negotiator{
+			RoundTripper: &http.Transport{},
+			Mechanisms:   mechanisms,
+			Credentials: CredentialProviderFunc(func(req *http.Request) (*Credentials, error) {
+				return &Credentials{User: "ДОМЕН\\" + username, Password: password, Workstation: "工作站"}, nil
+			}),
+		}}
+		res, err := client.Get(ts.URL)
+		if err != nil {
+			t.Fatalf("error sending request: %s", err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("expected status 200 with mechanisms %v, got %d", mechanisms, res.StatusCode)
+		}
+	}
+}
+
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestNegotiatorConnectionAffinity(t *testing.T) {
+	provider := CredentialProviderFunc(func(req *http.Request) (*Credentials, error) {
+		return &Credentials{User: username, Password: password, Domain: domain}, nil
+	})
+	ntlm := newTestServer().Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	// the server drops the connection after sending the challenge
+	closing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			w.Header().Set("Connection", "close")
+		}
+		ntlm.ServeHTTP(w, r)
+	}))
+	defer closing.Close()
+
+	client := &http.Client{Transport: Negotiator{RoundTripper: &http.Transport{}, Credentials: provider}}
+	_, err := client.Get(closing.URL)
+	if !errors.Is(err, ErrConnectionSwitched) {
+		t.Fatalf("expected connection switched error, got %v", err)
+	}
+	var he *HandshakeError
+	if !errors.As(err, &he) || he.Stage != StageChallenge || he.StatusCode != http.StatusUnauthorized || he.Flags == 0 {
+		t.Fatalf("expected a challenge HandshakeError with the status and flags, got %#v", he)
+	}
+
+	// a transport the negotiator cannot pin, speaking HTTP/2
+	h2 := httptest.NewUnstartedServer(ntlm)
+	h2.EnableHTTP2 = true
+	h2.StartTLS()
+	defer h2.Close()
+
+	rt := h2.Client().Transport
+	client = &http.Client{Transport: Negotiator{
+		RoundTripper: roundTripperFunc(rt.RoundTrip),
+		Credentials:  provider,
+	}}
+	_, err = client.Get(h2.URL)
+	if !errors.Is(err, ErrHTTP2) {
+		t.Fatalf("expected http/2 error, got %v", err)
+	}
+
+	// pinned to a single HTTP/1.1 connection when the transport is a http.Transport
+	client = &http.Client{Transport: Negotiator{RoundTripper: h2.Client().Transport, Credentials: provider}}
+	res, err := client.Get(h2.URL)
+	if err != nil {
+		t.Fatalf("error sending request: %s", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || res.ProtoMajor != 1 {
+		t.Fatalf("expected status 200 over HTTP/1.1, got %d over %s", res.StatusCode, res.Proto)
+	}
+}
+
+func TestNegotiatorHandshakeCache(t *testing.T) {
+	var mu sync.Mutex
+	anonymous := 0
+	server := newTestServer()
+	ntlm := server.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		if r.Header.Get("Authorization") == "" {
+			anonymous++
+		}
+		mu.Unlock()
+		ntlm.ServeHTTP(w, r)
+	}))
+	// the server keeps connections authenticated, like IIS does
+	ts.Config.ConnContext = server.ConnContext
+	ts.Start()
+	defer ts.Close()
+
+	cache := NewHandshakeCache()
+	rt := &http.Transport{}
+	get := func(creds *Credentials) {
+		client := &http.Client{Transport: Negotiator{
+			RoundTripper: rt,
+			Credentials: CredentialProviderFunc(func(req *http.Request) (*Credentials, error) {
+				return creds, nil
+			}),
+			Cache: cache,
+		}}
+		res, err := client.Get(ts.URL)
+		if err != nil {
+			t.Fatalf("error sending request: %s", err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", res.StatusCode)
+		}
+	}
+
+	creds := &Credentials{User: username, Password: password, Domain: domain}
+	for i := 0; i < 5; i++ {
+		get(creds)
+	}
+	// other credentials cannot use the authenticated connection
+	get(&Credentials{User: domain + "\\" + username, Password: password})
+
+	expected := HandshakeStats{Handshakes: 2, ProbesSkipped: 1, ConnectionsReused: 4}
+	if stats := cache.Stats(); stats != expected {
+		t.Fatalf("expected %+v, got %+v", expected, stats)
+	}
+	// the first anonymous try, and the requests on the authenticated connection
+	if anonymous != 5 {
+		t.Fatalf("expected 5 requests without authorization, got %d", anonymous)
+	}
+	cache.CloseIdleConnections()
+}
+
+func TestNegotiatorWithoutCache(t *testing.T) {
+	closed := make(chan struct{}, 10)
+	ts := httptest.NewUnstartedServer(newTestServer().Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	ts.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			closed <- struct{}{}
+		}
+	}
+	ts.Start()
+	defer ts.Close()
+
+	client := &http.Client{Transport: Negotiator{
+		RoundTripper: &http.Transport{},
+		Credentials: CredentialProviderFunc(func(req *http.Request) (*Credentials, error) {
+			return &Credentials{User: username, Password: password}, nil
+		}),
+	}}
+	res, err := client.Get(ts.URL)
+	if err != nil {
+		t.Fatalf("error sending request: %s", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+	// the authenticated connection is not kept without a cache
+	res.Body.Close()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the connection of the handshake to be closed")
+	}
+}
+
+func TestNegotiatorRequestBody(t *testing.T) {
+	var methods []string
+	bodies := 0
+	ntlm := newTestServer().Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	}))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		methods = append(methods, r.Method)
+		if len(body) > 0 {
+			bodies++
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		ntlm.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	provider := CredentialProviderFunc(func(req *http.Request) (*Credentials, error) {
+		return &Credentials{User: username, Password: password, Domain: domain}, nil
+	})
+	for _, table := range []struct {
+		probe   bool
+		getBody bool
+		methods string
+		bodies  int
+	}{
+		{false, true, "POST POST POST", 3},
+		{false, false, "POST POST POST", 3},
+		{true, false, "HEAD HEAD POST", 1},
+	} {
+		methods, bodies = nil, 0
+		getBodyCalls := 0
+		req, _ := http.NewRequest("POST", ts.URL, ioutil.NopCloser(strings.NewReader("body")))
+		if table.getBody {
+			req.GetBody = func() (io.ReadCloser, error) {
+				getBodyCalls++
+				return ioutil.NopCloser(strings.NewReader("body")), nil
+			}
+		}
+		client := &http.Client{Transport: Negotiator{
+			RoundTripper:   &http.Transport{},
+			Credentials:    provider,
+			EmptyBodyProbe: table.probe,
+		}}
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("error sending request: %s", err)
+		}
+		echo, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK || string(echo) != "body" {
+			t.Fatalf("expected status 200 with the body, got %d %q", res.StatusCode, echo)
+		}
+		if m := strings.Join(methods, " "); m != table.methods || bodies != table.bodies {
+			t.Fatalf("expected %s with %d bodies, got %s with %d bodies", table.methods, table.bodies, m, bodies)
+		}
+		if table.getBody && getBodyCalls != 2 {
+			t.Fatalf("expected the body to be read again with GetBody twice, got %d", getBodyCalls)
+		}
+	}
+}
+
+func TestNegotiatorLogger(t *testing.T) {
+	ts := httptest.NewServer(newTestServer().Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	defer ts.Close()
+
+	var out bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&out, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	for _, creds := range []*Credentials{
+		{User: username, Password: password, Domain: domain},
+		{User: username, Hash: ntlmHashHex, Domain: domain},
+		{User: username, Hash: "not a hash"},
+	} {
+		client := &http.Client{Transport: Negotiator{
+			RoundTripper: &http.Transport{},
+			Credentials: CredentialProviderFunc(func(req *http.Request) (*Credentials, error) {
+				return creds, nil
+			}),
+			Logger: logger,
+		}}
+		res, err := client.Get(ts.URL)
+		if err == nil {
+			res.Body.Close()
+		}
+	}
+
+	logs := out.String()
+	for _, s := range []string{"stage=server", "flags=", "host=" + strings.TrimPrefix(ts.URL, "http://")} {
+		if !strings.Contains(logs, s) {
+			t.Errorf("expected %q in logs:\n%s", s, logs)
+		}
+	}
+	// NTLM messages start with NTLMSSP, base64 TlRMTVNTUA
+	for _, secret := range []string{password, ntlmHashHex, "not a hash", "TlRMTVNTUA"} {
+		if strings.Contains(logs, secret) {
+			t.Errorf("secret %q in logs:\n%s", secret, logs)
+		}
+	}
+}
+
+func TestNegotiatorLoggerNTLMv1(t *testing.T) {
+	server := newTestServer()
+	server.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	ts := httptest.NewServer(server.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	defer ts.Close()
+
+	var out, packageOut bytes.Buffer
+	SetLogger(slog.New(slog.NewTextHandler(&packageOut, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	defer SetLogger(nil)
+
+	client := &http.Client{Transport: Negotiator{
+		RoundTripper: &http.Transport{},
+		Credentials: CredentialProviderFunc(func(req *http.Request) (*Credentials, error) {
+			return &Credentials{User: username, Password: password, Domain: domain}, nil
+		}),
+		Mechanisms: []Mechanism{NTLMMechanism{InsecureNTLMv1: true}},
+		Logger:     slog.New(slog.NewTextHandler(&out, &slog.HandlerOptions{Level: slog.LevelDebug})),
+	}}
+	res, err := client.Get(ts.URL)
+	if err == nil {
+		res.Body.Close()
+	}
+
+	if logs := out.String(); !strings.Contains(logs, "ntlm v1 enabled") || !strings.Contains(logs, "level=DEBUG") {
+		t.Fatalf("expected the ntlm v1 warning and the context logs in the logger of the negotiator, got:\n%s", logs)
+	}
+	if packageOut.Len() != 0 {
+		t.Fatalf("expected nothing in the package logger, got:\n%s", packageOut.String())
+	}
+}
@@ -2,14 +2,17 @@
 //
 // Protocol details from https://msdn.microsoft.com/en-us/library/cc236621.aspx,
 // implementation hints from http://davenport.sourceforge.net/ntlm.html .
-// This package only implements authentication, no key exchange or encryption. It
-// only supports Unicode (UTF16LE) encoding of protocol strings, no OEM encoding.
-// This package implements NTLMv2.
+// This package implements authentication, session key exchange, signing and sealing.
+// Protocol strings are encoded in Unicode (UTF16LE), or with an OEM code page for
+// servers that do not support Unicode.
+// This package implements NTLMv2, NTLMv1 responses are only computed on request
+// for legacy servers.
 package ntlmssp
 
 import (
 	"crypto/hmac"
 	"crypto/md5"
+	"crypto/rc4"
 	"golang.org/x/crypto/md4"
 	"strings"
 )
@@ -49,3 +52,20 @@ func hmacMd5(key []byte, data ...[]byte) []byte {
 	}
 	return mac.Sum(nil)
 }
+
+// computeNtlmV2SessionBaseKey derives the SessionBaseKey from the NTProofStr,
+// the first 16 bytes of the NTLMv2 response. For NTLMv2 the KeyExchangeKey
+// equals the SessionBaseKey.
+func computeNtlmV2SessionBaseKey(ntlmV2Hash, ntChallengeResponse []byte) []byte {
+	return hmacMd5(ntlmV2Hash, ntChallengeResponse[:16])
+}
+
+func rc4K(key, data []byte) ([]byte, error) {
+	cipher, err := rc4.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]byte, len(data))
+	cipher.XORKeyStream(result, data)
+	return result, nil
+}
@@ -2,9 +2,16 @@ package ntlmssp
 
 import (
 	"bytes"
+	"crypto/md5"
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
+	"io"
+	"reflect"
 	"strings"
 	"testing"
+	"testing/iotest"
+	"time"
 )
 
 // test cases from http://davenport.sourceforge.net/ntlm.html
@@ -156,3 +163,486 @@ func TestNTLMv2Hash(t *testing.T) {
 		t.Fatalf("expected %v, got %v", expected, v)
 	}
 }
+
+func newTestChallengeMessage(t *testing.T, flags NegotiateFlags, targetInfo []byte) []byte {
+	t.Helper()
+	ptr := binary.Size(&challengeMessageFields{})
+	targetName := toUnicode(target)
+	f := challengeMessageFields{
+		messageHeader:   newMessageHeader(2),
+		TargetName:      newVarField(&ptr, len(targetName)),
+		NegotiateFlags:  flags,
+		ServerChallenge: [8]byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef},
+		TargetInfo:      newVarField(&ptr, len(targetInfo)),
+	}
+	b := bytes.Buffer{}
+	if err := binary.Write(&b, binary.LittleEndian, &f); err != nil {
+		t.Fatalf("error writing challenge message: %s", err)
+	}
+	b.Write(targetName)
+	b.Write(targetInfo)
+	return b.Bytes()
+}
+
+func TestProcessChallengeKeyExchange(t *testing.T) {
+	flags := defaultFlags | negotiateFlagNTLMSSPNEGOTIATEKEYEXCH
+	cm := newTestChallengeMessage(t, flags, nil)
+
+	am, sessionKey, err := ProcessChallengeWithSessionKey(cm, username, password, true)
+	if err != nil {
+		t.Fatalf("error processing challenge: %s", err)
+	}
+	if len(sessionKey) != 16 {
+		t.Fatalf("expected a 16 byte session key, got %x", sessionKey)
+	}
+
+	var f authenticateMessageFields
+	if err := binary.Read(bytes.NewReader(am), binary.LittleEndian, &f); err != nil {
+		t.Fatalf("error reading authenticate message: %s", err)
+	}
+	ntResponse, _ := f.NtChallengeResponse.ReadFrom(am)
+	encryptedKey, _ := f.EncryptedRandomSessionKey.ReadFrom(am)
+
+	keyExchangeKey := computeNtlmV2SessionBaseKey(getNtlmV2Hash(password, username, target), ntResponse)
+	decryptedKey, err := rc4K(keyExchangeKey, encryptedKey)
+	if err != nil {
+		t.Fatalf("error decrypting session key: %s", err)
+	}
+	if !bytes.Equal(decryptedKey, sessionKey) {
+		t.Fatalf("expected %x, got %x", sessionKey, decryptedKey)
+	}
+
+	_, sessionKey, err = ProcessChallengeWithSessionKey(newTestChallengeMessage(t, defaultFlags, nil), username, password, true)
+	if err != nil {
+		t.Fatalf("error processing challenge: %s", err)
+	}
+	if len(sessionKey) != 16 {
+		t.Fatalf("expected a 16 byte session key without key exchange, got %x", sessionKey)
+	}
+}
+
+func TestProcessChallengeOEM(t *testing.T) {
+	flags := defaultFlags&^negotiateFlagNTLMSSPNEGOTIATEUNICODE | negotiateFlagNTLMNEGOTIATEOEM
+	for _, table := range []struct {
+		cp           *CodePage
+		user, domain string
+		encoded      []byte
+	}{
+		{CodePage850, "jürgen", "DÖMÄIN", []byte{'j', 0x81, 'r', 'g', 'e', 'n'}},
+		// ø is not in cp437
+		{CodePage850, "søren", "DØMAIN", []byte{'s', 0x9b, 'r', 'e', 'n'}},
+		// nor is € in cp850
+		{CodePage1252, "jürgen€", "DØMAIN", []byte{'j', 0xfc, 'r', 'g', 'e', 'n', 0x80}},
+	} {
+		cm, err := ChallengeMessage{
+			NegotiateFlags:  flags,
+			TargetName:      table.domain,
+			ServerChallenge: [8]byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef},
+			CodePage:        table.cp,
+		}.MarshalBinary()
+		if err != nil {
+			t.Fatalf("error creating challenge message: %s", err)
+		}
+
+		b, _, err := ProcessChallengeWithOptions(cm, table.user, password, true, ChallengeOptions{CodePage: table.cp})
+		if err != nil {
+			t.Fatalf("error processing challenge: %s", err)
+		}
+		if !bytes.Contains(b, table.encoded) {
+			t.Fatalf("expected user name encoded with %s, got %x", table.cp.name, b)
+		}
+
+		// the NTLMv2 response is computed from the names sent in the message
+		am := AuthenticateMessage{CodePage: table.cp}
+		if err := am.UnmarshalBinary(b); err != nil {
+			t.Fatalf("error parsing authenticate message: %s", err)
+		}
+		if am.UserName != table.user || am.DomainName != table.domain {
+			t.Fatalf("expected %s and %s, got %s and %s", table.user, table.domain, am.UserName, am.DomainName)
+		}
+		checkNTLMv2Response(t, am, am.UserName, am.DomainName)
+	}
+
+	cm, err := ChallengeMessage{NegotiateFlags: flags, TargetName: "DÖMÄIN", CodePage: CodePage850}.MarshalBinary()
+	if err != nil {
+		t.Fatalf("error creating challenge message: %s", err)
+	}
+	if !bytes.Contains(cm, []byte{'D', 0x99, 'M', 0x8e, 'I', 'N'}) {
+		t.Fatalf("expected target name encoded with cp850, got %x", cm)
+	}
+	if _, _, err := ProcessChallengeWithOptions(cm, "jürgen€", password, true, ChallengeOptions{CodePage: CodePage850}); !errors.Is(err, ErrNotEncodable) {
+		t.Fatalf("expected ErrNotEncodable, got %v", err)
+	}
+}
+
+func TestProcessChallengeNTLMv1(t *testing.T) {
+	// MS-NLMP 4.2.2.1.1
+	if lm := getLmHash("Password", nil); !bytes.Equal(lm, []byte{0xe5, 0x2c, 0xac, 0x67, 0x41, 0x9a, 0x9a, 0x22, 0x4a, 0x3b, 0x10, 0x8f, 0x3f, 0xa6, 0xcb, 0x6d}) {
+		t.Fatalf("unexpected LMOWFv1 %x", lm)
+	}
+	if lm := getLmHash("a password longer than 14", nil); lm != nil {
+		t.Fatalf("expected no LM hash for a long password, got %x", lm)
+	}
+
+	serverChallenge := []byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef}
+	opts := ChallengeOptions{InsecureNTLMv1: true}
+	for _, table := range []struct {
+		name  string
+		flags NegotiateFlags
+	}{
+		{"ntlm2 session", defaultFlags | negotiateFlagNTLMSSPNEGOTIATEKEYEXCH},
+		{"ntlm v1", negotiateFlagNTLMSSPNEGOTIATEUNICODE},
+		{"ntlm v1 lm key", negotiateFlagNTLMSSPNEGOTIATEUNICODE | negotiateFlagNTLMSSPNEGOTIATELMKEY},
+	} {
+		b, sessionKey, err := ProcessChallengeWithOptions(newTestChallengeMessage(t, table.flags, nil), username, password, true, opts)
+		if err != nil {
+			t.Fatalf("%s: error processing challenge: %s", table.name, err)
+		}
+		var am AuthenticateMessage
+		if err := am.UnmarshalBinary(b); err != nil {
+			t.Fatalf("%s: error parsing authenticate message: %s", table.name, err)
+		}
+		if len(am.NtChallengeResponse) != 24 || len(am.LmChallengeResponse) != 24 || len(sessionKey) != 16 {
+			t.Fatalf("%s: unexpected response lengths %d, %d, %d", table.name, len(am.NtChallengeResponse), len(am.LmChallengeResponse), len(sessionKey))
+		}
+		expected := desl(getNtlmHash(password), serverChallenge)
+		if table.flags.Has(negotiateFlagNTLMSSPNEGOTIATEEXTENDEDSESSIONSECURITY) {
+			expected = desl(getNtlmHash(password), md5Sum(serverChallenge, am.LmChallengeResponse[:8])[:8])
+		}
+		if !bytes.Equal(am.NtChallengeResponse, expected) {
+			t.Fatalf("%s: expected NT response %x, got %x", table.name, expected, am.NtChallengeResponse)
+		}
+	}
+
+	if _, _, err := ProcessChallengeWithHashAndOptions(newTestChallengeMessage(t, negotiateFlagNTLMSSPNEGOTIATEUNICODE|negotiateFlagNTLMSSPNEGOTIATELMKEY, nil),
+		username, ntlmHashHex, opts); !errors.Is(err, ErrNTLMv1NotSupported) {
+		t.Fatalf("expected ErrNTLMv1NotSupported for the lm key without lm hash, got %v", err)
+	}
+}
+
+func TestProcessChallengeAnonymous(t *testing.T) {
+	cm := newTestChallengeMessage(t, defaultFlags|negotiateFlagNTLMSSPNEGOTIATEKEYEXCH, nil)
+	b, sessionKey, err := ProcessChallengeWithOptions(cm, "", "", true, ChallengeOptions{Anonymous: true})
+	if err != nil {
+		t.Fatalf("error processing challenge: %s", err)
+	}
+	var am AuthenticateMessage
+	if err := am.UnmarshalBinary(b); err != nil {
+		t.Fatalf("error parsing authenticate message: %s", err)
+	}
+	if !am.NegotiateFlags.Has(negotiateFlagANONYMOUS) {
+		t.Fatalf("expected NTLMSSP_ANONYMOUS, got %s", am.NegotiateFlags)
+	}
+	if am.UserName != "" || am.DomainName != "" || am.NtChallengeResponse != nil || !bytes.Equal(am.LmChallengeResponse, []byte{0}) {
+		t.Fatalf("expected empty names and responses, got %+v", am)
+	}
+	decryptedKey, _ := rc4K(make([]byte, 16), am.EncryptedRandomSessionKey)
+	if !bytes.Equal(decryptedKey, sessionKey) {
+		t.Fatalf("expected session key %x encrypted with the zero key, got %x", sessionKey, decryptedKey)
+	}
+}
+
+func TestProcessChallengeWorkstationVersion(t *testing.T) {
+	version := Version{ProductMajorVersion: 10, ProductBuild: 20348, NTLMRevisionCurrent: 15}
+	opts := ChallengeOptions{Workstation: workstation, Version: &version}
+	for _, table := range []struct {
+		flags   NegotiateFlags
+		version *Version
+	}{
+		{defaultFlags | negotiateFlagNTLMSSPNEGOTIATEVERSION, &version},
+		{defaultFlags, nil},
+	} {
+		b, _, err := ProcessChallengeWithOptions(newTestChallengeMessage(t, table.flags, nil), username, password, true, opts)
+		if err != nil {
+			t.Fatalf("error processing challenge: %s", err)
+		}
+		var am AuthenticateMessage
+		if err := am.UnmarshalBinary(b); err != nil {
+			t.Fatalf("error parsing authenticate message: %s", err)
+		}
+		if am.Workstation != workstation {
+			t.Fatalf("expected workstation %s, got %s", workstation, am.Workstation)
+		}
+		if !reflect.DeepEqual(am.Version, table.version) {
+			t.Fatalf("expected version %+v with flags %s, got %+v", table.version, table.flags, am.Version)
+		}
+	}
+}
+
+func TestProcessChallengeMIC(t *testing.T) {
+	timestamp := []byte{0x00, 0x90, 0xd3, 0x36, 0xb7, 0x34, 0xc3, 0x01}
+	targetInfo := marshalAVPairs(AVPairs{
+		{MsvAvNbDomainName, toUnicode(target)},
+		{MsvAvTimestamp, timestamp},
+	})
+	cm := newTestChallengeMessage(t, defaultFlags|negotiateFlagNTLMSSPNEGOTIATEKEYEXCH, targetInfo)
+	nm, err := NewNegotiateMessage(domain, "")
+	if err != nil {
+		t.Fatalf("error creating negotiate message: %s", err)
+	}
+
+	am, sessionKey, err := ProcessChallengeWithOptions(cm, username, password, true, ChallengeOptions{NegotiateMessage: nm})
+	if err != nil {
+		t.Fatalf("error processing challenge: %s", err)
+	}
+
+	mic := append([]byte{}, am[micOffset:micOffset+16]...)
+	zeroed := append([]byte{}, am...)
+	copy(zeroed[micOffset:], make([]byte, 16))
+	if expected := hmacMd5(sessionKey, nm, cm, zeroed); !bytes.Equal(mic, expected) {
+		t.Fatalf("expected MIC %x, got %x", expected, mic)
+	}
+
+	var f authenticateMessageFields
+	if err := binary.Read(bytes.NewReader(am), binary.LittleEndian, &f); err != nil {
+		t.Fatalf("error reading authenticate message: %s", err)
+	}
+	ntResponse, _ := f.NtChallengeResponse.ReadFrom(am)
+	var pairs AVPairs
+	if err := pairs.UnmarshalBinary(ntResponse[44:]); err != nil {
+		t.Fatalf("error parsing echoed target info: %s", err)
+	}
+	if v := pairs.Get(MsvAvFlags); !bytes.Equal(v, []byte{0x02, 0x00, 0x00, 0x00}) {
+		t.Fatalf("expected MsvAvFlags with MIC present bit, got %x", v)
+	}
+}
+
+func TestProcessChallengeChannelBindings(t *testing.T) {
+	cb := &ChannelBindings{ApplicationData: []byte("tls-server-end-point:0123456789abcdef0123456789abcdef")}
+	d, err := cb.MarshalBinary()
+	if err != nil {
+		t.Fatalf("error marshaling channel bindings: %s", err)
+	}
+	if expected := append(make([]byte, 16), 0x35, 0x00, 0x00, 0x00); !bytes.Equal(d[:20], expected) || !bytes.Equal(d[20:], cb.ApplicationData) {
+		t.Fatalf("unexpected channel bindings structure %x", d)
+	}
+
+	targetInfo := marshalAVPairs(AVPairs{{MsvAvNbDomainName, toUnicode(target)}})
+	cm := newTestChallengeMessage(t, defaultFlags, targetInfo)
+	am, _, err := ProcessChallengeWithOptions(cm, username, password, true, ChallengeOptions{ChannelBindings: cb})
+	if err != nil {
+		t.Fatalf("error processing challenge: %s", err)
+	}
+
+	var f authenticateMessageFields
+	if err := binary.Read(bytes.NewReader(am), binary.LittleEndian, &f); err != nil {
+		t.Fatalf("error reading authenticate message: %s", err)
+	}
+	ntResponse, _ := f.NtChallengeResponse.ReadFrom(am)
+	var pairs AVPairs
+	if err := pairs.UnmarshalBinary(ntResponse[44:]); err != nil {
+		t.Fatalf("error parsing echoed target info: %s", err)
+	}
+	if v, expected := pairs.Get(MsvAvChannelBindings), md5.Sum(d); !bytes.Equal(v, expected[:]) {
+		t.Fatalf("expected MsvAvChannelBindings %x, got %x", expected, v)
+	}
+}
+
+func TestHandshakeErrors(t *testing.T) {
+	lmKey := negotiateFlagNTLMSSPNEGOTIATEUNICODE | negotiateFlagNTLMSSPNEGOTIATELMKEY
+	for _, table := range []struct {
+		name  string
+		err   error
+		is    error
+		stage HandshakeStage
+		flags NegotiateFlags
+	}{
+		{"garbage challenge", func() error {
+			_, err := ProcessChallenge([]byte("garbage challenge message data, not ntlm"), username, password, true)
+			return err
+		}(), ErrInvalidMessage, StageChallenge, 0},
+		{"ntlm v1", func() error {
+			_, err := ProcessChallenge(newTestChallengeMessage(t, lmKey, nil), username, password, true)
+			return err
+		}(), ErrNTLMv1NotSupported, StageChallenge, lmKey},
+		{"anonymous", func() error {
+			_, err := ProcessChallenge(newTestChallengeMessage(t, defaultFlags, nil), "", "", true)
+			return err
+		}(), ErrAnonymousNotSupported, StageAuthenticate, 0},
+		{"invalid hash", func() error {
+			_, err := ProcessChallengeWithHash(newTestChallengeMessage(t, defaultFlags, nil), username, "0123")
+			return err
+		}(), ErrInvalidHash, StageAuthenticate, 0},
+		{"short type 3 challenge", func() error {
+			_, err := GenerateType3([]byte("NTLMSSP"), username, password, domain, true)
+			return err
+		}(), ErrInvalidMessage, StageChallenge, 0},
+		{"type 3 without domain", func() error {
+			_, err := GenerateType3(newTestChallengeMessage(t, defaultFlags, nil), username, password, "", true)
+			return err
+		}(), ErrDomainRequired, StageAuthenticate, defaultFlags},
+		{"type 3 anonymous", func() error {
+			_, err := GenerateType3(newTestChallengeMessage(t, defaultFlags, nil), "", "", domain, true)
+			return err
+		}(), ErrAnonymousNotSupported, StageAuthenticate, 0},
+		{"type 3 ntlm v1", func() error {
+			_, err := GenerateType3(newTestChallengeMessage(t, lmKey, nil), username, password, domain, true)
+			return err
+		}(), ErrNTLMv1NotSupported, StageChallenge, lmKey},
+	} {
+		if !errors.Is(table.err, table.is) {
+			t.Fatalf("%s: expected %v, got %v", table.name, table.is, table.err)
+		}
+		var he *HandshakeError
+		if !errors.As(table.err, &he) {
+			t.Fatalf("%s: expected a HandshakeError, got %T", table.name, table.err)
+		}
+		if he.Stage != table.stage || he.Flags != table.flags {
+			t.Fatalf("%s: expected stage %s with flags %s, got %s with %s", table.name, table.stage, table.flags, he.Stage, he.Flags)
+		}
+	}
+}
+
+func TestNewAuthenticateMessage(t *testing.T) {
+	ntlmV2Hash := getNtlmV2Hash(password, username, target)
+	clientChallenge := []byte{0xff, 0xff, 0xff, 0x00, 0x11, 0x22, 0x33, 0x44}
+	timestamp := []byte{0x00, 0x90, 0xd3, 0x36, 0xb7, 0x34, 0xc3, 0x01}
+	ntResponse := computeNtlmV2Response(ntlmV2Hash, challenge, clientChallenge, timestamp, nil)
+	lmResponse := computeLmV2Response(ntlmV2Hash, challenge, clientChallenge)
+
+	b, err := NewAuthenticateMessage(target, username, workstation, ntResponse, lmResponse, nil, timestamp, clientChallenge)
+	if err != nil {
+		t.Fatalf("error creating authenticate message: %s", err)
+	}
+	expected, _ := hex.DecodeString("4e544c4d53535000030000001800180064000000300030007c000000" +
+		"0c000c0048000000080008005400000008000800" + "5c00000000000000ac000000018088a20601b11d0000000f" +
+		"44004f004d00410049004e0075007300650072004d00590050004300" +
+		"d6e6152ea25d03b7c6ba6629c2d6aaf0ffffff0011223344" +
+		"bd6aedbfa65858a6b9515b228e226ed901010000000000000090d336b734c301ffffff00112233440000000000000000")
+	if !bytes.Equal(b, expected) {
+		t.Fatalf("expected %x, got %x", expected, b)
+	}
+}
+
+// checkNTLMv2Response checks the NTLMv2 response of am against the password,
+// user and domain, and returns the timestamp it carries
+func checkNTLMv2Response(t *testing.T, am AuthenticateMessage, user, domain string) []byte {
+	t.Helper()
+	nt := am.NtChallengeResponse
+	if len(nt) < 48 {
+		t.Fatalf("short NTLMv2 response %x", nt)
+	}
+	expected := computeNtlmV2Response(getNtlmV2Hash(password, user, domain), challenge, nt[32:40], nt[24:32], nt[44:len(nt)-4])
+	if !bytes.Equal(nt, expected) {
+		t.Fatalf("expected NTLMv2 response %x, got %x", expected, nt)
+	}
+	return nt[24:32]
+}
+
+func TestGenerateType3(t *testing.T) {
+	timestamp := []byte{0x00, 0x90, 0xd3, 0x36, 0xb7, 0x34, 0xc3, 0x01}
+	flags := defaultFlags | negotiateFlagNTLMSSPNEGOTIATEKEYEXCH | negotiateFlagNTLMSSPNEGOTIATEVERSION
+	cm := newTestChallengeMessage(t, flags, marshalAVPairs(AVPairs{
+		{MsvAvNbDomainName, toUnicode(target)},
+		{MsvAvTimestamp, timestamp},
+	}))
+
+	type3, err := GenerateType3(cm, username, password, target, true)
+	if err != nil {
+		t.Fatalf("error generating type 3 message: %s", err)
+	}
+	processed, _, err := ProcessChallengeWithOptions(cm, username, password, true, ChallengeOptions{})
+	if err != nil {
+		t.Fatalf("error processing challenge: %s", err)
+	}
+
+	var am, expected AuthenticateMessage
+	if err := am.UnmarshalBinary(type3); err != nil {
+		t.Fatalf("error parsing type 3 message: %s", err)
+	}
+	if err := expected.UnmarshalBinary(processed); err != nil {
+		t.Fatalf("error parsing authenticate message: %s", err)
+	}
+	if ts := checkNTLMv2Response(t, am, username, target); !bytes.Equal(ts, timestamp) {
+		t.Fatalf("expected server timestamp %x, got %x", timestamp, ts)
+	}
+	checkNTLMv2Response(t, expected, username, target)
+
+	// the responses and the session key are random, the rest is the same
+	for _, m := range []*AuthenticateMessage{&am, &expected} {
+		m.NtChallengeResponse, m.EncryptedRandomSessionKey = nil, nil
+	}
+	if !reflect.DeepEqual(am, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, am)
+	}
+	if am.NegotiateFlags != flags || !bytes.Equal(am.LmChallengeResponse, make([]byte, 24)) {
+		t.Fatalf("expected the flags of the server and a Z(24) LM response, got %s and %x", am.NegotiateFlags, am.LmChallengeResponse)
+	}
+
+	// the domain of the user is used instead of the target name
+	type3, err = GenerateType3(cm, username, password, domain, true)
+	if err != nil {
+		t.Fatalf("error generating type 3 message: %s", err)
+	}
+	if err := am.UnmarshalBinary(type3); err != nil {
+		t.Fatalf("error parsing type 3 message: %s", err)
+	}
+	checkNTLMv2Response(t, am, username, domain)
+	if am.DomainName != domain {
+		t.Fatalf("expected domain %q, got %q", domain, am.DomainName)
+	}
+
+	if _, err := GenerateType3(cm, username, password, "", true); !errors.Is(err, ErrDomainRequired) {
+		t.Fatalf("expected %v, got %v", ErrDomainRequired, err)
+	}
+}
+
+func TestProcessChallengeRandAndClock(t *testing.T) {
+	// davenport NTLMv2 inputs, the time is 0x01c334b736d39000 as FILETIME
+	clientChallenge := []byte{0xff, 0xff, 0xff, 0x00, 0x11, 0x22, 0x33, 0x44}
+	timestamp := []byte{0x00, 0x90, 0xd3, 0x36, 0xb7, 0x34, 0xc3, 0x01}
+	now := func() time.Time { return time.Unix(0, (0x01c334b736d39000-116444736000000000)*100) }
+	exportedSessionKey := bytes.Repeat([]byte{0x55}, 16)
+	targetInfo := marshalAVPairs(AVPairs{
+		{MsvAvNbDomainName, toUnicode(target)},
+		{MsvAvNbComputerName, toUnicode("SERVER")},
+	})
+	cm := newTestChallengeMessage(t, defaultFlags|negotiateFlagNTLMSSPNEGOTIATEKEYEXCH, targetInfo)
+
+	var messages [][]byte
+	for i := 0; i < 2; i++ {
+		rand := bytes.NewReader(append(append([]byte{}, clientChallenge...), exportedSessionKey...))
+		b, sessionKey, err := ProcessChallengeWithOptions(cm, username, password, true, ChallengeOptions{Rand: rand, Now: now})
+		if err != nil {
+			t.Fatalf("error processing challenge: %s", err)
+		}
+		if !bytes.Equal(sessionKey, exportedSessionKey) {
+			t.Fatalf("expected exported session key %x, got %x", exportedSessionKey, sessionKey)
+		}
+		messages = append(messages, b)
+	}
+	if !bytes.Equal(messages[0], messages[1]) {
+		t.Fatalf("expected identical messages, got %x and %x", messages[0], messages[1])
+	}
+
+	var am AuthenticateMessage
+	if err := am.UnmarshalBinary(messages[0]); err != nil {
+		t.Fatalf("error parsing authenticate message: %s", err)
+	}
+	ntlmV2Hash := getNtlmV2Hash(password, username, target)
+	if expected := computeNtlmV2Response(ntlmV2Hash, challenge, clientChallenge, timestamp, targetInfo); !bytes.Equal(am.NtChallengeResponse, expected) {
+		t.Fatalf("expected NTLMv2 response %x, got %x", expected, am.NtChallengeResponse)
+	}
+	if expected, _ := hex.DecodeString("d6e6152ea25d03b7c6ba6629c2d6aaf0ffffff0011223344"); !bytes.Equal(am.LmChallengeResponse, expected) {
+		t.Fatalf("expected LMv2 response %x, got %x", expected, am.LmChallengeResponse)
+	}
+
+	errEntropy := errors.New("no entropy")
+	for _, table := range []struct {
+		name string
+		rand io.Reader
+		is   error
+	}{
+		{"failing reader", iotest.ErrReader(errEntropy), errEntropy},
+		{"short reader", bytes.NewReader(exportedSessionKey[:12]), io.ErrUnexpectedEOF},
+	} {
+		_, _, err := ProcessChallengeWithOptions(cm, username, password, true, ChallengeOptions{Rand: table.rand, Now: now})
+		if !errors.Is(err, table.is) {
+			t.Fatalf("%s: expected %v, got %v", table.name, table.is, err)
+		}
+		var he *HandshakeError
+		if !errors.As(err, &he) || he.Stage != StageAuthenticate {
+			t.Fatalf("%s: expected a HandshakeError at the authenticate stage, got %v", table.name, err)
+		}
+	}
+}
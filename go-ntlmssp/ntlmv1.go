@@ -0,0 +1,89 @@
+package ntlmssp
+
+import (
+	"crypto/des"
+	"strings"
+
+	"golang.org/x/crypto/md4"
+)
+
+// NTLMv1, NTLM2 session and LM responses, see
+// https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-nlmp/464551a8-9fc4-428e-b3d3-bc5bfb2e73a5
+// They are broken and only computed with ChallengeOptions.InsecureNTLMv1.
+
+var lmMagic = []byte("KGS!@#$%")
+
+// getLmHash returns LMOWFv1 of password, nil if the password has no LM hash
+// because it is longer than 14 characters or not encodable with cp.
+func getLmHash(password string, cp *CodePage) []byte {
+	oem, err := cp.encodeString(strings.ToUpper(password))
+	if err != nil || len(oem) > 14 {
+		return nil
+	}
+	key := make([]byte, 14)
+	copy(key, oem)
+	return append(desEncrypt(key[:7], lmMagic), desEncrypt(key[7:], lmMagic)...)
+}
+
+// desEncrypt encrypts the 8 byte block data with the 7 byte key, expanded
+// to a DES key.
+func desEncrypt(key7, data []byte) []byte {
+	key := make([]byte, 8)
+	key[0] = key7[0]
+	for i := 1; i < 7; i++ {
+		key[i] = key7[i-1]<<(8-i) | key7[i]>>i
+	}
+	key[7] = key7[6] << 1
+	// the low bit is the parity bit, ignored by DES
+	cipher, _ := des.NewCipher(key)
+	b := make([]byte, 8)
+	cipher.Encrypt(b, data)
+	return b
+}
+
+// desl encrypts data with the three DES keys from the 16 byte key.
+func desl(key, data []byte) []byte {
+	k := make([]byte, 21)
+	copy(k, key)
+	b := desEncrypt(k[:7], data)
+	b = append(b, desEncrypt(k[7:14], data)...)
+	return append(b, desEncrypt(k[14:], data)...)
+}
+
+// computeNtlmV1Response returns the NT and LM responses and the key exchange
+// key. With extended session security, these are the NTLM2 session responses.
+// Without the LM hash, the NT response is sent as LM response.
+func computeNtlmV1Response(flags NegotiateFlags, ntHash, lmHash, serverChallenge, clientChallenge []byte) (nt, lm, keyExchangeKey []byte, err error) {
+	sessionBaseKey := md4Sum(ntHash)
+	if flags.Has(negotiateFlagNTLMSSPNEGOTIATEEXTENDEDSESSIONSECURITY) {
+		nt = desl(ntHash, md5Sum(serverChallenge, clientChallenge)[:8])
+		lm = append(append([]byte{}, clientChallenge...), make([]byte, 16)...)
+		return nt, lm, hmacMd5(sessionBaseKey, serverChallenge, lm[:8]), nil
+	}
+
+	nt = desl(ntHash, serverChallenge)
+	lm = nt
+	if lmHash != nil {
+		lm = desl(lmHash, serverChallenge)
+	}
+	switch {
+	case flags.Has(negotiateFlagNTLMSSPNEGOTIATELMKEY):
+		if lmHash == nil {
+			logger().Debug("lm key requested, but no lm hash")
+			return nil, nil, nil, ErrNTLMv1NotSupported
+		}
+		keyExchangeKey = append(desEncrypt(lmHash[:7], lm[:8]),
+			desEncrypt(append([]byte{lmHash[7]}, 0xbd, 0xbd, 0xbd, 0xbd, 0xbd, 0xbd), lm[:8])...)
+	case flags.Has(negotiateFlagNTLMSSPREQUESTNONNTSESSIONKEY) && lmHash != nil:
+		keyExchangeKey = append(append([]byte{}, lmHash[:8]...), make([]byte, 8)...)
+	default:
+		keyExchangeKey = sessionBaseKey
+	}
+	return nt, lm, keyExchangeKey, nil
+}
+
+func md4Sum(data []byte) []byte {
+	h := md4.New()
+	h.Write(data)
+	return h.Sum(nil)
+}
@@ -0,0 +1,234 @@
+package ntlmssp
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// ProxyDialer dials connections tunneled through an HTTP proxy with CONNECT,
+// answering NTLM/Negotiate challenges from the proxy on the tunnel connection.
+// Use its DialContext as the DialContext of a http.Transport without Proxy set:
+//
+//	dialer := &ntlmssp.ProxyDialer{ProxyURL: proxyURL, Credentials: provider}
+//	client := &http.Client{Transport: &http.Transport{DialContext: dialer.DialContext}}
+type ProxyDialer struct {
+	// ProxyURL is the http or https URL of the proxy
+	ProxyURL *url.URL
+
+	// Credentials supplies the credentials for the proxy. The request passed to
+	// the provider is the CONNECT request.
+	Credentials CredentialProvider
+
+	// Dialer is used to connect to the proxy, a zero net.Dialer if nil
+	Dialer *net.Dialer
+
+	// TLSClientConfig is used for https proxies
+	TLSClientConfig *tls.Config
+
+	// Logger receives the debug output of the handshakes, the package logger
+	// is used if nil
+	Logger *slog.Logger
+
+	// Mechanisms are the security mechanisms offered with the Negotiate
+	// scheme, see Negotiator
+	Mechanisms []Mechanism
+}
+
+// DialContext connects to addr through the proxy.
+func (d *ProxyDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := d.dialProxy(ctx, network)
+	if err != nil {
+		return nil, err
+	}
+	tunnel, err := d.connect(ctx, conn, addr)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tunnel, nil
+}
+
+func (d *ProxyDialer) logger() *slog.Logger {
+	return loggerOr(d.Logger).With("proxy", d.ProxyURL.Host)
+}
+
+func (d *ProxyDialer) dialProxy(ctx context.Context, network string) (net.Conn, error) {
+	dialer := d.Dialer
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+	host := d.ProxyURL.Host
+	if d.ProxyURL.Port() == "" {
+		if d.ProxyURL.Scheme == "https" {
+			host = net.JoinHostPort(d.ProxyURL.Hostname(), "443")
+		} else {
+			host = net.JoinHostPort(d.ProxyURL.Hostname(), "80")
+		}
+	}
+	conn, err := dialer.DialContext(ctx, network, host)
+	if err != nil {
+		d.logger().Debug("error dialing proxy", "error", err)
+		return nil, err
+	}
+	if d.ProxyURL.Scheme != "https" {
+		return conn, nil
+	}
+
+	config := d.TLSClientConfig
+	if config == nil {
+		config = &tls.Config{}
+	}
+	if config.ServerName == "" {
+		config = config.Clone()
+		config.ServerName = d.ProxyURL.Hostname()
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		d.logger().Debug("error in tls handshake with proxy", "error", err)
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// connect sends CONNECT requests on conn until the proxy accepts or refuses the tunnel.
+func (d *ProxyDialer) connect(ctx context.Context, conn net.Conn, addr string) (net.Conn, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	br := bufio.NewReader(conn)
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+
+	res, err := d.roundTrip(conn, br, req)
+	if err != nil {
+		return nil, err
+	}
+	if d.Credentials != nil && proxyAuthScheme.challenged(res) {
+		creds, err := d.Credentials.Credentials(req)
+		if err != nil {
+			d.logger().Debug("error getting credentials", "error", err)
+			return nil, err
+		}
+		if creds != nil {
+			res, err = d.authenticate(conn, br, req, res, creds)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if res.StatusCode != http.StatusOK {
+		d.logger().Debug("proxy refused to connect", "addr", addr, "status", res.Status)
+		return nil, fmt.Errorf("%w to %s: %s", ErrProxyRefused, addr, res.Status)
+	}
+
+	if br.Buffered() > 0 {
+		return &bufferedConn{conn, br}, nil
+	}
+	return conn, nil
+}
+
+// authenticate performs the handshake with the proxy on conn.
+func (d *ProxyDialer) authenticate(conn net.Conn, br *bufio.Reader, req *http.Request, res *http.Response, creds *Credentials) (*http.Response, error) {
+	h := newClientHandshake(d.Mechanisms, d.ProxyURL.Hostname(), creds, d.logger())
+
+	// send negotiate
+	resauth := authheader(res.Header.Values(proxyAuthScheme.challengeHeader))
+	token, err := h.negotiateToken(resauth)
+	if err != nil {
+		return nil, handshakeError(StageNegotiate, 0, 0, err)
+	}
+	stage := StageNegotiate
+	for leg := 1; ; leg++ {
+		proxyAuthScheme.setAuthorization(req.Header, resauth, token)
+		res, err = d.roundTrip(conn, br, req)
+		if err != nil {
+			return nil, handshakeError(stage, h.flags(), 0, err)
+		}
+		if res.StatusCode == http.StatusOK {
+			token, err := authheader(res.Header.Values(proxyAuthScheme.challengeHeader)).GetData()
+			if err == nil {
+				err = h.verify(token)
+			}
+			if err != nil {
+				return nil, handshakeError(stage, h.flags(), res.StatusCode, err)
+			}
+			return res, nil
+		}
+
+		// receive challenge?
+		resauth = authheader(res.Header.Values(proxyAuthScheme.challengeHeader))
+		challengeToken, err := resauth.GetData()
+		if err != nil {
+			d.logger().Debug("error getting challenge data", "error", err)
+			return nil, handshakeError(StageChallenge, h.flags(), res.StatusCode, err)
+		}
+		if h.complete || res.StatusCode != http.StatusProxyAuthRequired || len(challengeToken) == 0 {
+			// Negotiation failed, report the response
+			d.logger().Debug("negotiation with proxy failed")
+			return res, nil
+		}
+		if leg == maxLegs {
+			d.logger().Debug("too many legs in handshake")
+			return nil, handshakeError(stage, h.flags(), res.StatusCode, ErrHandshakeIncomplete)
+		}
+		if res.Close {
+			d.logger().Debug("proxy closed the connection during the handshake")
+			return nil, handshakeError(StageChallenge, tokenFlags(challengeToken), res.StatusCode, ErrConnectionSwitched)
+		}
+
+		// send authenticate
+		if token, err = h.nextToken(challengeToken, nil); err != nil {
+			stage = StageChallenge
+			if h.flags() != 0 {
+				stage = StageAuthenticate
+			}
+			return nil, handshakeError(stage, h.flags(), res.StatusCode, err)
+		}
+		stage = StageAuthenticate
+	}
+}
+
+// roundTrip writes req to conn and reads the response, discarding its body
+// since the connection is reused.
+func (d *ProxyDialer) roundTrip(conn net.Conn, br *bufio.Reader, req *http.Request) (*http.Response, error) {
+	if err := req.Write(conn); err != nil {
+		d.logger().Debug("error writing connect request", "error", err)
+		return nil, err
+	}
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		d.logger().Debug("error reading connect response", "error", err)
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, res.Body)
+		res.Body.Close()
+	}
+	return res, nil
+}
+
+// bufferedConn is a net.Conn whose first bytes were already read into a bufio.Reader
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
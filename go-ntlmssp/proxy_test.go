@@ -0,0 +1,145 @@
+package ntlmssp
+
+import (
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+)
+
+// newTestProxy returns a proxy handler that requires NTLM authentication with
+// Proxy-Authorization before passing requests on to next.
+func newTestProxy(next http.HandlerFunc) http.Handler {
+	s := newTestServer()
+	var mu sync.Mutex
+	contexts := make(map[string]*ServerContext)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, _ := authheader(r.Header.Values("Proxy-Authorization")).GetData()
+
+		if len(token) >= 12 && token[8] == 1 {
+			c := s.NewContext()
+			challengeMessage, err := c.ProcessNegotiate(token)
+			if err == nil {
+				mu.Lock()
+				contexts[r.RemoteAddr] = c
+				mu.Unlock()
+				w.Header().Set("Proxy-Authenticate", "NTLM "+base64.StdEncoding.EncodeToString(challengeMessage))
+				w.WriteHeader(http.StatusProxyAuthRequired)
+				return
+			}
+		}
+		mu.Lock()
+		c := contexts[r.RemoteAddr]
+		mu.Unlock()
+		if len(token) >= 12 && token[8] == 3 && c != nil {
+			if _, err := c.ProcessAuthenticate(token); err == nil {
+				next(w, r)
+				return
+			}
+		}
+		w.Header().Set("Proxy-Authenticate", "NTLM")
+		w.WriteHeader(http.StatusProxyAuthRequired)
+	})
+}
+
+func TestNegotiatorProxyCredentials(t *testing.T) {
+	proxy := httptest.NewServer(newTestProxy(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "proxied")
+	}))
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+
+	for _, table := range []struct {
+		creds  *Credentials
+		status int
+	}{
+		{&Credentials{User: username, Password: password}, http.StatusOK},
+		{&Credentials{User: username, Password: "wrong"}, http.StatusProxyAuthRequired},
+	} {
+		client := &http.Client{Transport: Negotiator{
+			RoundTripper: &http.Transport{Proxy: http.ProxyURL(proxyURL)},
+			ProxyCredentials: CredentialProviderFunc(func(req *http.Request) (*Credentials, error) {
+				return table.creds, nil
+			}),
+		}}
+		res, err := client.Get("http://www.example.com/")
+		if err != nil {
+			t.Fatalf("error sending request: %s", err)
+		}
+		res.Body.Close()
+		if res.StatusCode != table.status {
+			t.Fatalf("expected status %d, got %d", table.status, res.StatusCode)
+		}
+	}
+}
+
+func TestProxyDialer(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "tunneled")
+	}))
+	defer ts.Close()
+
+	proxy := httptest.NewServer(newTestProxy(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		target, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			target.Close()
+			return
+		}
+		go func() {
+			io.Copy(target, brw)
+			target.Close()
+		}()
+		io.Copy(conn, target)
+		conn.Close()
+	}))
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+
+	for _, table := range []struct {
+		creds *Credentials
+		ok    bool
+	}{
+		{&Credentials{User: username, Password: password}, true},
+		{&Credentials{User: username, Password: "wrong"}, false},
+	} {
+		dialer := &ProxyDialer{
+			ProxyURL: proxyURL,
+			Credentials: CredentialProviderFunc(func(req *http.Request) (*Credentials, error) {
+				return table.creds, nil
+			}),
+		}
+		transport := ts.Client().Transport.(*http.Transport).Clone()
+		transport.DialContext = dialer.DialContext
+		res, err := (&http.Client{Transport: transport}).Get(ts.URL)
+		if !table.ok {
+			if err == nil {
+				res.Body.Close()
+				t.Fatalf("expected tunnel to be refused")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("error sending request: %s", err)
+		}
+		b, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		if string(b) != "tunneled" {
+			t.Fatalf("expected tunneled response, got %q", b)
+		}
+	}
+}
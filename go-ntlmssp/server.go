@@ -0,0 +1,308 @@
+package ntlmssp
+
+import (
+	"crypto/hmac"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// CredentialStore looks up the secrets needed to validate AUTHENTICATE messages.
+type CredentialStore interface {
+	// NTHash returns the NT hash (MD4 of the UTF16LE password) of the user in
+	// the given domain, or an error if the user is unknown.
+	NTHash(user, domain string) ([]byte, error)
+}
+
+// CredentialStoreFunc is an adapter to allow the use of ordinary functions as
+// a CredentialStore.
+type CredentialStoreFunc func(user, domain string) ([]byte, error)
+
+// NTHash calls f(user, domain).
+func (f CredentialStoreFunc) NTHash(user, domain string) ([]byte, error) {
+	return f(user, domain)
+}
+
+// Server holds the configuration used to accept NTLM authentication from clients.
+// The name fields are sent to clients as AV pairs in the target info of the
+// CHALLENGE message.
+type Server struct {
+	// TargetName is the NetBIOS domain (or server) name clients authenticate against
+	TargetName string
+
+	NetBIOSComputerName string
+	NetBIOSDomainName   string
+	DNSComputerName     string
+	DNSDomainName       string
+	DNSTreeName         string
+
+	// Credentials validates the users, it must be set
+	Credentials CredentialStore
+
+	// AllowAnonymous accepts anonymous authentication (null sessions), the
+	// Identity of those clients has Anonymous set
+	AllowAnonymous bool
+
+	// MaxClockSkew bounds the difference between the clock of the server and
+	// the timestamp of the NTLMv2 responses, 36 hours (the MaxLifetime of
+	// MS-NLMP) if zero
+	MaxClockSkew time.Duration
+
+	// Negotiate makes Handler offer the Negotiate scheme, with SPNEGO tokens,
+	// instead of NTLM
+	Negotiate bool
+
+	// Logger receives the debug output of the handshakes, the package logger
+	// is used if nil
+	Logger *slog.Logger
+
+	pending pendingContexts
+}
+
+// defaultMaxClockSkew is the MaxLifetime of MS-NLMP 3.2.5.1.2
+const defaultMaxClockSkew = 36 * time.Hour
+
+func (s *Server) maxClockSkew() time.Duration {
+	if s.MaxClockSkew == 0 {
+		return defaultMaxClockSkew
+	}
+	return s.MaxClockSkew
+}
+
+// Identity describes a successfully authenticated client.
+type Identity struct {
+	User        string
+	Domain      string
+	Workstation string
+
+	// Anonymous is set for anonymous clients, with an empty User and Domain
+	Anonymous bool
+}
+
+// ServerContext is the server side of a single NTLM handshake.
+type ServerContext struct {
+	server *Server
+
+	negotiateMessage []byte
+	challengeMessage []byte
+	serverChallenge  [8]byte
+	flags            NegotiateFlags
+
+	exportedSessionKey []byte
+
+	// mechTypes is the DER mechTypes list of the SPNEGO NegTokenInit, if any
+	mechTypes []byte
+}
+
+// NewContext starts a new handshake.
+func (s *Server) NewContext() *ServerContext {
+	return &ServerContext{server: s}
+}
+
+func (s *Server) logger() *slog.Logger {
+	return loggerOr(s.Logger)
+}
+
+func (s *Server) targetInfo(now time.Time) ([]byte, error) {
+	var pairs AVPairs
+	for _, p := range []struct {
+		id    AVID
+		value string
+	}{
+		{MsvAvNbDomainName, s.NetBIOSDomainName},
+		{MsvAvNbComputerName, s.NetBIOSComputerName},
+		{MsvAvDNSDomainName, s.DNSDomainName},
+		{MsvAvDNSComputerName, s.DNSComputerName},
+		{MsvAvDNSTreeName, s.DNSTreeName},
+	} {
+		if p.value != "" {
+			pairs.SetString(p.id, p.value)
+		}
+	}
+	pairs.SetTimestamp(now)
+	return pairs.MarshalBinary()
+}
+
+// ProcessNegotiate parses the NEGOTIATE message sent by the client and returns
+// the CHALLENGE message to send back.
+func (c *ServerContext) ProcessNegotiate(negotiateMessageData []byte) ([]byte, error) {
+	var nm NegotiateMessage
+	if err := nm.UnmarshalBinary(negotiateMessageData); err != nil {
+		c.server.logger().Debug("failed unmarshaling negotiate message data", "error", err)
+		return nil, err
+	}
+	if !nm.NegotiateFlags.Has(negotiateFlagNTLMSSPNEGOTIATEUNICODE) {
+		c.server.logger().Debug("only unicode is supported")
+		return nil, ErrUnicodeRequired
+	}
+
+	// answer with the subset of the requested flags that this package supports
+	flags := negotiateFlagNTLMSSPNEGOTIATEUNICODE |
+		negotiateFlagNTLMSSPNEGOTIATENTLM |
+		negotiateFlagNTLMSSPNEGOTIATETARGETINFO |
+		negotiateFlagNTLMSSPTARGETTYPEDOMAIN
+	flags |= nm.NegotiateFlags & (negotiateFlagNTLMSSPREQUESTTARGET |
+		negotiateFlagNTLMSSPNEGOTIATEEXTENDEDSESSIONSECURITY |
+		negotiateFlagNTLMSSPNEGOTIATESIGN |
+		negotiateFlagNTLMSSPNEGOTIATESEAL |
+		negotiateFlagNTLMSSPNEGOTIATEALWAYSSIGN |
+		negotiateFlagNTLMSSPNEGOTIATEKEYEXCH |
+		negotiateFlagNTLMSSPNEGOTIATE128 |
+		negotiateFlagNTLMSSPNEGOTIATE56 |
+		negotiateFlagNTLMSSPNEGOTIATEVERSION)
+
+	serverChallenge, err := generateServerChallenge()
+	if err != nil {
+		c.server.logger().Debug("error generating server challenge", "error", err)
+		return nil, err
+	}
+
+	targetInfo, err := c.server.targetInfo(time.Now())
+	if err != nil {
+		c.server.logger().Debug("error creating target info", "error", err)
+		return nil, err
+	}
+
+	cm := ChallengeMessage{
+		NegotiateFlags:  flags,
+		TargetName:      c.server.TargetName,
+		ServerChallenge: serverChallenge,
+		TargetInfo:      targetInfo,
+	}
+	if flags.Has(negotiateFlagNTLMSSPNEGOTIATEVERSION) {
+		version := DefaultVersion()
+		cm.Version = &version
+	}
+	challengeMessageData, err := cm.MarshalBinary()
+	if err != nil {
+		c.server.logger().Debug("error marshaling challenge message", "error", err)
+		return nil, err
+	}
+
+	c.negotiateMessage = negotiateMessageData
+	c.challengeMessage = challengeMessageData
+	c.serverChallenge = serverChallenge
+	c.flags = flags
+	return challengeMessageData, nil
+}
+
+// ProcessAuthenticate validates the AUTHENTICATE message sent by the client in
+// response to the CHALLENGE message returned by ProcessNegotiate.
+func (c *ServerContext) ProcessAuthenticate(authenticateMessageData []byte) (*Identity, error) {
+	if c.challengeMessage == nil {
+		c.server.logger().Debug("no challenge was sent")
+		return nil, fmt.Errorf("%w: no challenge was sent, process a negotiate message first", ErrHandshakeIncomplete)
+	}
+	if c.server.Credentials == nil {
+		c.server.logger().Debug("no credential store configured")
+		return nil, ErrNoCredentialStore
+	}
+
+	var am AuthenticateMessage
+	if err := am.UnmarshalBinary(authenticateMessageData); err != nil {
+		c.server.logger().Debug("failed unmarshaling authenticate message data", "error", err)
+		return nil, err
+	}
+	if am.UserName == "" && len(am.NtChallengeResponse) == 0 {
+		return c.processAnonymous(am)
+	}
+	// NTProofStr plus the fixed part of the NTLMv2 client challenge
+	if len(am.NtChallengeResponse) < 16+28 {
+		c.server.logger().Debug("only ntlm v2 is supported")
+		return nil, ErrNTLMv1NotSupported
+	}
+
+	ntHash, err := c.server.Credentials.NTHash(am.UserName, am.DomainName)
+	if err != nil {
+		c.server.logger().Debug("error looking up credentials", "error", err)
+		return nil, err
+	}
+
+	ntlmV2Hash := hmacMd5(ntHash, toUnicode(strings.ToUpper(am.UserName)+am.DomainName))
+	ntProofStr, blob := am.NtChallengeResponse[:16], am.NtChallengeResponse[16:]
+	if !hmac.Equal(ntProofStr, hmacMd5(ntlmV2Hash, c.serverChallenge[:], blob)) {
+		c.server.logger().Debug("invalid ntlm v2 response")
+		return nil, ErrInvalidCredentials
+	}
+
+	// blob: header (8), timestamp (8), client challenge (8), reserved (4), target info
+	if skew := time.Since(parseTimestamp(blob[8:16])).Abs(); skew > c.server.maxClockSkew() {
+		c.server.logger().Debug("ntlm v2 response timestamp outside the allowed clock skew", "skew", skew)
+		return nil, fmt.Errorf("%w: %s", ErrClockSkew, skew)
+	}
+
+	keyExchangeKey := computeNtlmV2SessionBaseKey(ntlmV2Hash, am.NtChallengeResponse)
+	exportedSessionKey := keyExchangeKey
+	if c.flags.Has(negotiateFlagNTLMSSPNEGOTIATEKEYEXCH) {
+		if len(am.EncryptedRandomSessionKey) != 16 {
+			c.server.logger().Debug("key exchange negotiated, but no session key sent")
+			return nil, ErrMissingSessionKey
+		}
+		exportedSessionKey, err = rc4K(keyExchangeKey, am.EncryptedRandomSessionKey)
+		if err != nil {
+			c.server.logger().Debug("error decrypting exported session key", "error", err)
+			return nil, err
+		}
+	}
+
+	var pairs AVPairs
+	if err := pairs.UnmarshalBinary(blob[28:]); err != nil {
+		c.server.logger().Debug("error parsing client target info", "error", err)
+		return nil, err
+	}
+	if pairs.Flags().Has(AVFlagMICPresent) {
+		if am.MIC == nil {
+			c.server.logger().Debug("mic announced but not present")
+			return nil, fmt.Errorf("%w: mic announced but not present", ErrInvalidMIC)
+		}
+		zeroed := append([]byte{}, authenticateMessageData...)
+		copy(zeroed[micOffset:micOffset+16], make([]byte, 16))
+		if !hmac.Equal(am.MIC, hmacMd5(exportedSessionKey, c.negotiateMessage, c.challengeMessage, zeroed)) {
+			c.server.logger().Debug("invalid mic")
+			return nil, ErrInvalidMIC
+		}
+	}
+
+	c.exportedSessionKey = exportedSessionKey
+	c.server.logger().Debug("client authenticated", "user", am.UserName, "domain", am.DomainName, "flags", c.flags.String())
+	return &Identity{
+		User:        am.UserName,
+		Domain:      am.DomainName,
+		Workstation: am.Workstation,
+	}, nil
+}
+
+// processAnonymous accepts an anonymous AUTHENTICATE message, MS-NLMP 3.2.5.1.2.
+func (c *ServerContext) processAnonymous(am AuthenticateMessage) (*Identity, error) {
+	if !c.server.AllowAnonymous {
+		c.server.logger().Debug("anonymous authentication not enabled")
+		return nil, ErrAnonymousNotSupported
+	}
+	if len(am.LmChallengeResponse) > 1 || len(am.LmChallengeResponse) == 1 && am.LmChallengeResponse[0] != 0 {
+		c.server.logger().Debug("invalid lm response for anonymous authentication")
+		return nil, fmt.Errorf("%w: invalid lm response for anonymous authentication", ErrInvalidMessage)
+	}
+
+	// the session base key of anonymous sessions is all zeros
+	exportedSessionKey := make([]byte, 16)
+	if c.flags.Has(negotiateFlagNTLMSSPNEGOTIATEKEYEXCH) && len(am.EncryptedRandomSessionKey) == 16 {
+		var err error
+		if exportedSessionKey, err = rc4K(exportedSessionKey, am.EncryptedRandomSessionKey); err != nil {
+			return nil, err
+		}
+	}
+	c.exportedSessionKey = exportedSessionKey
+	c.server.logger().Debug("anonymous client authenticated", "workstation", am.Workstation, "flags", c.flags.String())
+	return &Identity{Workstation: am.Workstation, Anonymous: true}, nil
+}
+
+// Session returns the Session established by a successful handshake, to sign
+// and seal messages exchanged with the client.
+func (c *ServerContext) Session() (*Session, error) {
+	if c.exportedSessionKey == nil {
+		c.server.logger().Debug("handshake not completed")
+		return nil, ErrHandshakeIncomplete
+	}
+	return newSession(c.flags, c.exportedSessionKey, false)
+}
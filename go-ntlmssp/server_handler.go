@@ -0,0 +1,361 @@
+package ntlmssp
+
+import (
+	"context"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// pendingContextTimeout bounds how long a client may take to answer a challenge
+const pendingContextTimeout = time.Minute
+
+type identityContextKey struct{}
+
+// IdentityFromContext returns the Identity of the client authenticated by the
+// Server.Handler middleware.
+func IdentityFromContext(ctx context.Context) (*Identity, bool) {
+	id, ok := ctx.Value(identityContextKey{}).(*Identity)
+	return id, ok
+}
+
+type connContextKey struct{}
+
+// connIdentity is the client authenticated on a connection
+type connIdentity struct {
+	mu sync.Mutex
+	id *Identity
+}
+
+// ConnContext keeps the clients authenticated on the connections served by
+// Handler, which then accepts their following requests without a handshake,
+// as IIS does. Set it as the ConnContext of the http.Server:
+//
+//	srv := &http.Server{Handler: s.Handler(next), ConnContext: s.ConnContext}
+//
+// Without it, every request is authenticated with its own handshake.
+func (s *Server) ConnContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connContextKey{}, &connIdentity{})
+}
+
+// connIdentityFromRequest returns the client authenticated on the connection of r, and
+// the holder to set it, nil if the http.Server has no ConnContext.
+func connIdentityFromRequest(r *http.Request) (*Identity, *connIdentity) {
+	conn, ok := r.Context().Value(connContextKey{}).(*connIdentity)
+	if !ok {
+		return nil, nil
+	}
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	return conn.id, conn
+}
+
+func (c *connIdentity) set(id *Identity) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.id = id
+	c.mu.Unlock()
+}
+
+// maxPendingContexts bounds the handshakes awaiting an AUTHENTICATE message,
+// the oldest are dropped first
+const maxPendingContexts = 10000
+
+type pendingContext struct {
+	*ServerContext
+	created time.Time
+}
+
+type pendingKey struct {
+	conn    any
+	created time.Time
+}
+
+// pendingContexts tracks handshakes awaiting an AUTHENTICATE message, keyed by the
+// client connection since NTLM authenticates connections, not requests. The
+// connection is the holder set by ConnContext, or the remote address without it.
+type pendingContexts struct {
+	mu       sync.Mutex
+	contexts map[any]pendingContext
+
+	// order lists the puts oldest first, to expire the contexts without
+	// scanning them. Its keys are stale once the context is taken or put again.
+	order []pendingKey
+}
+
+func (p *pendingContexts) put(conn any, c *ServerContext) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	if p.contexts == nil {
+		p.contexts = make(map[any]pendingContext)
+	}
+	_, restarted := p.contexts[conn]
+	for len(p.order) > 0 && (now.Sub(p.order[0].created) > pendingContextTimeout || !restarted && len(p.contexts) >= maxPendingContexts) {
+		p.drop(p.order[0])
+		p.order = p.order[1:]
+	}
+	if len(p.order) > 2*maxPendingContexts {
+		// most keys are stale, for instance after many handshakes on a connection
+		order := make([]pendingKey, 0, len(p.contexts))
+		for _, k := range p.order {
+			if v, ok := p.contexts[k.conn]; ok && v.created.Equal(k.created) {
+				order = append(order, k)
+			}
+		}
+		p.order = order
+	}
+	p.contexts[conn] = pendingContext{c, now}
+	p.order = append(p.order, pendingKey{conn, now})
+}
+
+// drop deletes the context of k, unless it was put again since
+func (p *pendingContexts) drop(k pendingKey) {
+	if v, ok := p.contexts[k.conn]; ok && v.created.Equal(k.created) {
+		delete(p.contexts, k.conn)
+	}
+}
+
+func (p *pendingContexts) take(conn any) *ServerContext {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	v, ok := p.contexts[conn]
+	if !ok {
+		return nil
+	}
+	delete(p.contexts, conn)
+	if time.Since(v.created) > pendingContextTimeout {
+		return nil
+	}
+	return v.ServerContext
+}
+
+// pendingConn returns the key of the pending handshake of r: the holder of its
+// connection, or its remote address if the http.Server has no ConnContext.
+func pendingConn(r *http.Request, conn *connIdentity) any {
+	if conn != nil {
+		return conn
+	}
+	return r.RemoteAddr
+}
+
+// Handler returns a http.Handler middleware that requires NTLM authentication
+// before passing requests on to next. The authenticated client is available
+// through IdentityFromContext. Set ConnContext on the http.Server to keep
+// the connections authenticated.
+//
+// Handshakes in progress are tracked by connection with ConnContext, and by
+// the remote address of the requests without it. Behind a proxy, whose
+// address is shared by its clients, and with HTTP/2, ConnContext is required
+// to tell the handshakes apart.
+//
+// Both the NTLM and the Negotiate schemes are accepted, with SPNEGO wrapped or
+// raw NTLM tokens for Negotiate. The scheme offered to clients is NTLM, or
+// Negotiate when s.Negotiate is set.
+func (s *Server) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger := s.logger().With("remote", r.RemoteAddr)
+		reqauth := authheader(r.Header.Values("Authorization"))
+		connID, conn := connIdentityFromRequest(r)
+		pending := pendingConn(r, conn)
+		var scheme string
+		switch {
+		case reqauth.IsNTLM():
+			scheme = "NTLM"
+		case reqauth.IsNegotiate():
+			scheme = "Negotiate"
+		case connID != nil:
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityContextKey{}, connID)))
+			return
+		default:
+			s.unauthorized(w, "", nil)
+			return
+		}
+		// a new handshake authenticates the connection again
+		conn.set(nil)
+		token, err := reqauth.GetData()
+		if err != nil {
+			logger.Debug("invalid authorization token")
+			s.unauthorized(w, "", nil)
+			return
+		}
+
+		spnego := scheme == "Negotiate" && !isNTLMMessage(token)
+		var mechTypes, mechListMIC []byte
+		if spnego {
+			var ntlmOffered bool
+			token, mechTypes, mechListMIC, ntlmOffered, err = unwrapSPNEGO(token)
+			if err != nil {
+				logger.Debug("invalid spnego token", "error", err)
+				s.unauthorized(w, "", nil)
+				return
+			}
+			if mechTypes != nil && !ntlmOffered {
+				logger.Debug("ntlm not offered in spnego mechanisms")
+				s.rejectSPNEGO(w)
+				return
+			}
+			if mechTypes != nil && !isNTLMMessage(token) {
+				// the optimistic token is for another mechanism, select NTLM
+				c := s.NewContext()
+				c.mechTypes = mechTypes
+				s.pending.put(pending, c)
+				s.continueSPNEGO(w, nil)
+				return
+			}
+		}
+		if len(token) < 12 {
+			logger.Debug("invalid authorization token")
+			s.unauthorized(w, "", nil)
+			return
+		}
+
+		switch binary.LittleEndian.Uint32(token[8:12]) {
+		case 1:
+			c := s.pending.take(pending)
+			if c == nil || c.challengeMessage != nil || mechTypes != nil {
+				c = s.NewContext()
+				c.mechTypes = mechTypes
+			}
+			challengeMessage, err := c.ProcessNegotiate(token)
+			if err != nil {
+				logger.Debug("error processing negotiate message", "error", err)
+				s.unauthorized(w, "", nil)
+				return
+			}
+			s.pending.put(pending, c)
+			if spnego {
+				s.continueSPNEGO(w, challengeMessage)
+			} else {
+				s.unauthorized(w, scheme, challengeMessage)
+			}
+		case 3:
+			c := s.pending.take(pending)
+			if c == nil {
+				logger.Debug("no pending handshake")
+				s.unauthorized(w, "", nil)
+				return
+			}
+			id, err := c.ProcessAuthenticate(token)
+			if err != nil {
+				logger.Debug("error processing authenticate message", "error", err)
+				s.unauthorized(w, "", nil)
+				return
+			}
+			if spnego {
+				final, err := c.completeSPNEGO(mechListMIC)
+				if err != nil {
+					logger.Debug("error completing spnego negotiation", "error", err)
+					s.rejectSPNEGO(w)
+					return
+				}
+				w.Header().Set("Www-Authenticate", "Negotiate "+base64.StdEncoding.EncodeToString(final))
+			}
+			conn.set(id)
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityContextKey{}, id)))
+		default:
+			logger.Debug("unexpected message type in authorization token")
+			s.unauthorized(w, "", nil)
+		}
+	})
+}
+
+// unwrapSPNEGO returns the mechanism token of a NegTokenInit or NegTokenResp,
+// the DER mechTypes list of a NegTokenInit, and the mechListMIC.
+func unwrapSPNEGO(token []byte) (mechToken, mechTypes, mechListMIC []byte, ntlmOffered bool, err error) {
+	if len(token) > 0 && token[0] == 0xa1 {
+		var resp NegTokenResp
+		if err := resp.UnmarshalBinary(token); err != nil {
+			return nil, nil, nil, false, err
+		}
+		return resp.ResponseToken, nil, resp.MechListMIC, false, nil
+	}
+	var init NegTokenInit
+	if err := init.UnmarshalBinary(token); err != nil {
+		return nil, nil, nil, false, err
+	}
+	for _, mech := range init.MechTypes {
+		ntlmOffered = ntlmOffered || mech.Equal(MechTypeNTLMSSP)
+	}
+	mechTypes, err = asn1.Marshal(init.MechTypes)
+	if err != nil {
+		return nil, nil, nil, false, err
+	}
+	return init.MechToken, mechTypes, init.MechListMIC, ntlmOffered, nil
+}
+
+// completeSPNEGO verifies the mechListMIC of the client, and returns the last
+// NegTokenResp with the mechListMIC of the server.
+func (c *ServerContext) completeSPNEGO(mechListMIC []byte) ([]byte, error) {
+	mechTypes := c.mechTypes
+	if mechTypes == nil {
+		mechTypes = ntlmMechTypes()
+	}
+	state := NegStateAcceptCompleted
+	resp := NegTokenResp{NegState: &state}
+	if c.flags.Has(negotiateFlagNTLMSSPNEGOTIATESIGN) && c.flags.Has(negotiateFlagNTLMSSPNEGOTIATEEXTENDEDSESSIONSECURITY) {
+		session, err := c.Session()
+		if err != nil {
+			return nil, err
+		}
+		if mechListMIC != nil {
+			if err := session.Verify(mechTypes, mechListMIC); err != nil {
+				return nil, fmt.Errorf("%w: mechListMIC: %w", ErrInvalidMIC, err)
+			}
+		}
+		if resp.MechListMIC, err = session.Sign(mechTypes); err != nil {
+			return nil, err
+		}
+	}
+	return resp.MarshalBinary()
+}
+
+func (s *Server) continueSPNEGO(w http.ResponseWriter, challengeMessage []byte) {
+	state := NegStateAcceptIncomplete
+	token, err := NegTokenResp{
+		NegState:      &state,
+		SupportedMech: MechTypeNTLMSSP,
+		ResponseToken: challengeMessage,
+	}.MarshalBinary()
+	if err != nil {
+		s.unauthorized(w, "", nil)
+		return
+	}
+	s.unauthorized(w, "Negotiate", token)
+}
+
+func (s *Server) rejectSPNEGO(w http.ResponseWriter) {
+	state := NegStateReject
+	token, err := NegTokenResp{NegState: &state}.MarshalBinary()
+	if err != nil {
+		s.unauthorized(w, "", nil)
+		return
+	}
+	s.unauthorized(w, "Negotiate", token)
+}
+
+// unauthorized answers with a 401 carrying token for scheme, or offering the
+// scheme of the server when scheme is empty.
+func (s *Server) unauthorized(w http.ResponseWriter, scheme string, token []byte) {
+	if scheme == "" {
+		scheme = "NTLM"
+		if s.Negotiate {
+			scheme = "Negotiate"
+		}
+	}
+	if token != nil {
+		w.Header().Set("Www-Authenticate", scheme+" "+base64.StdEncoding.EncodeToString(token))
+	} else {
+		w.Header().Set("Www-Authenticate", scheme)
+	}
+	w.WriteHeader(http.StatusUnauthorized)
+}
@@ -0,0 +1,371 @@
+package ntlmssp
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestServer accepts the test user of its domain, target, and of the
+// trusted domain of the tests
+func newTestServer() *Server {
+	return &Server{
+		TargetName:        target,
+		NetBIOSDomainName: target,
+		DNSComputerName:   "server.domain.com",
+		Credentials: CredentialStoreFunc(func(user, userDomain string) ([]byte, error) {
+			if user != username || userDomain != target && userDomain != domain {
+				return nil, errors.New("unknown user")
+			}
+			return getNtlmHash(password), nil
+		}),
+	}
+}
+
+func TestServerHandler(t *testing.T) {
+	handler := newTestServer().Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, ok := IdentityFromContext(r.Context())
+		if !ok {
+			t.Errorf("no identity in request context")
+			return
+		}
+		fmt.Fprintf(w, "%s\\%s", id.Domain, id.User)
+	}))
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	client := &http.Client{Transport: Negotiator{RoundTripper: &http.Transport{}}}
+	for _, table := range []struct {
+		u, p   string
+		status int
+	}{
+		{domain + "\\" + username, password, http.StatusOK},
+		{domain + "\\" + username, "wrong", http.StatusUnauthorized},
+		{"someone", password, http.StatusUnauthorized},
+	} {
+		req, _ := http.NewRequest("GET", ts.URL, nil)
+		req.SetBasicAuth(table.u, table.p)
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("error sending request: %s", err)
+		}
+		res.Body.Close()
+		if res.StatusCode != table.status {
+			t.Fatalf("expected status %d for %s, got %d", table.status, table.u, res.StatusCode)
+		}
+	}
+}
+
+func TestServerHandlerWorkstation(t *testing.T) {
+	version := Version{ProductMajorVersion: 10, ProductBuild: 20348, NTLMRevisionCurrent: 15}
+	ts := httptest.NewServer(newTestServer().Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id, _ := IdentityFromContext(r.Context()); id.Workstation != workstation {
+			t.Errorf("expected workstation %s, got %+v", workstation, id)
+		}
+		var am AuthenticateMessage
+		token, _ := authheader(r.Header.Values("Authorization")).GetData()
+		if err := am.UnmarshalBinary(token); err != nil || am.Version == nil || *am.Version != version {
+			t.Errorf("expected version %+v, got %+v (%v)", version, am.Version, err)
+		}
+	})))
+	defer ts.Close()
+
+	client := &http.Client{Transport: Negotiator{
+		RoundTripper: &http.Transport{},
+		Workstation:  strings.ToLower(workstation),
+		Mechanisms:   []Mechanism{NTLMMechanism{Version: &version}},
+	}}
+	req, _ := http.NewRequest("GET", ts.URL, nil)
+	req.SetBasicAuth(domain+"\\"+username, password)
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("error sending request: %s", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+}
+
+func TestServerHandlerAnonymous(t *testing.T) {
+	for _, allow := range []bool{true, false} {
+		s := newTestServer()
+		s.AllowAnonymous = allow
+		ts := httptest.NewServer(s.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if id, ok := IdentityFromContext(r.Context()); !ok || !id.Anonymous || id.User != "" {
+				t.Errorf("expected anonymous identity, got %+v", id)
+			}
+		})))
+		defer ts.Close()
+
+		client := &http.Client{Transport: Negotiator{
+			RoundTripper: &http.Transport{},
+			Credentials: CredentialProviderFunc(func(req *http.Request) (*Credentials, error) {
+				return &Credentials{Anonymous: true}, nil
+			}),
+		}}
+		res, err := client.Get(ts.URL)
+		if err != nil {
+			t.Fatalf("error sending request: %s", err)
+		}
+		res.Body.Close()
+		if expected := map[bool]int{true: http.StatusOK, false: http.StatusUnauthorized}[allow]; res.StatusCode != expected {
+			t.Fatalf("expected status %d with AllowAnonymous %v, got %d", expected, allow, res.StatusCode)
+		}
+	}
+}
+
+func TestServerHandlerConnection(t *testing.T) {
+	s := newTestServer()
+	ts := httptest.NewUnstartedServer(s.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id, ok := IdentityFromContext(r.Context()); !ok || id.User != username {
+			t.Errorf("expected identity of %s, got %+v", username, id)
+		}
+	})))
+	ts.Config.ConnContext = s.ConnContext
+	ts.Start()
+	defer ts.Close()
+
+	rt := &http.Transport{MaxConnsPerHost: 1}
+	get := func(token []byte) *http.Response {
+		req, _ := http.NewRequest("GET", ts.URL, nil)
+		if token != nil {
+			req.Header.Set("Authorization", "NTLM "+base64.StdEncoding.EncodeToString(token))
+		}
+		res, err := rt.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("error sending request: %s", err)
+		}
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+		return res
+	}
+
+	nm, err := NewNegotiateMessage("", "")
+	if err != nil {
+		t.Fatalf("error creating negotiate message: %s", err)
+	}
+	cm, err := authheader(get(nm).Header.Values("Www-Authenticate")).GetData()
+	if err != nil {
+		t.Fatalf("error reading challenge message: %s", err)
+	}
+	am, err := ProcessChallenge(cm, username, password, true)
+	if err != nil {
+		t.Fatalf("error processing challenge: %s", err)
+	}
+	for _, token := range [][]byte{am, nil, nil} {
+		if res := get(token); res.StatusCode != http.StatusOK {
+			t.Fatalf("expected status 200 on the authenticated connection, got %d", res.StatusCode)
+		}
+	}
+
+	rt.CloseIdleConnections()
+	if res := get(nil); res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected status 401 on a new connection, got %d", res.StatusCode)
+	}
+}
+
+func TestServerHandlerSharedAddress(t *testing.T) {
+	s := newTestServer()
+	handler := s.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	// two clients behind a proxy, on their own connections from its address
+	conns := []context.Context{s.ConnContext(context.Background(), nil), s.ConnContext(context.Background(), nil)}
+	serve := func(ctx context.Context, token []byte) *http.Response {
+		req := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+		req.RemoteAddr = "192.0.2.1:3128"
+		req.Header.Set("Authorization", "NTLM "+base64.StdEncoding.EncodeToString(token))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Result()
+	}
+
+	nm, err := NewNegotiateMessage("", "")
+	if err != nil {
+		t.Fatalf("error creating negotiate message: %s", err)
+	}
+	var challenges [][]byte
+	for _, ctx := range conns {
+		cm, err := authheader(serve(ctx, nm).Header.Values("Www-Authenticate")).GetData()
+		if err != nil {
+			t.Fatalf("error reading challenge message: %s", err)
+		}
+		challenges = append(challenges, cm)
+	}
+	for i, ctx := range conns {
+		am, err := ProcessChallenge(challenges[i], username, password, true)
+		if err != nil {
+			t.Fatalf("error processing challenge: %s", err)
+		}
+		if res := serve(ctx, am); res.StatusCode != http.StatusOK {
+			t.Fatalf("expected status 200 for client %d, got %d", i, res.StatusCode)
+		}
+	}
+}
+
+func TestServerHandlerNegotiate(t *testing.T) {
+	s := newTestServer()
+	s.Negotiate = true
+	ts := httptest.NewServer(s.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	defer ts.Close()
+
+	var final string
+	client := &http.Client{Transport: Negotiator{RoundTripper: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		res, err := http.DefaultTransport.RoundTrip(req)
+		if err == nil && res.StatusCode == http.StatusOK {
+			final = res.Header.Get("Www-Authenticate")
+		}
+		return res, err
+	})}}
+	for _, table := range []struct {
+		p      string
+		status int
+	}{
+		{password, http.StatusOK},
+		{"wrong", http.StatusUnauthorized},
+	} {
+		req, _ := http.NewRequest("GET", ts.URL, nil)
+		req.SetBasicAuth(domain+"\\"+username, table.p)
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("error sending request: %s", err)
+		}
+		res.Body.Close()
+		if res.StatusCode != table.status {
+			t.Fatalf("expected status %d, got %d", table.status, res.StatusCode)
+		}
+	}
+
+	// the last token carries the mechListMIC, verified by the Negotiator
+	token, err := authheader([]string{final}).GetData()
+	if err != nil {
+		t.Fatalf("error decoding final token %q: %s", final, err)
+	}
+	var resp NegTokenResp
+	if err := resp.UnmarshalBinary(token); err != nil {
+		t.Fatalf("error parsing final token: %s", err)
+	}
+	if resp.NegState == nil || *resp.NegState != NegStateAcceptCompleted || len(resp.MechListMIC) != 16 {
+		t.Fatalf("expected accept-completed with a mechListMIC, got %+v", resp)
+	}
+}
+
+func TestServerContextSession(t *testing.T) {
+	s := newTestServer()
+	c := s.NewContext()
+
+	nm, err := NewSessionNegotiateMessage("", "")
+	if err != nil {
+		t.Fatalf("error creating negotiate message: %s", err)
+	}
+	cm, err := c.ProcessNegotiate(nm)
+	if err != nil {
+		t.Fatalf("error processing negotiate message: %s", err)
+	}
+	am, sessionKey, err := ProcessChallengeWithOptions(cm, username, password, true, ChallengeOptions{NegotiateMessage: nm})
+	if err != nil {
+		t.Fatalf("error processing challenge: %s", err)
+	}
+	id, err := c.ProcessAuthenticate(am)
+	if err != nil {
+		t.Fatalf("error processing authenticate message: %s", err)
+	}
+	if id.User != username || id.Domain != target {
+		t.Fatalf("unexpected identity %+v", id)
+	}
+
+	clientSession, err := NewClientSession(am, sessionKey)
+	if err != nil {
+		t.Fatalf("error creating client session: %s", err)
+	}
+	serverSession, err := c.Session()
+	if err != nil {
+		t.Fatalf("error creating server session: %s", err)
+	}
+	sealed, signature, err := clientSession.Seal([]byte("message"))
+	if err != nil {
+		t.Fatalf("error sealing message: %s", err)
+	}
+	if _, err := serverSession.Unseal(sealed, signature); err != nil {
+		t.Fatalf("error unsealing message: %s", err)
+	}
+}
+
+func TestPendingContexts(t *testing.T) {
+	var p pendingContexts
+	for i := 0; i < maxPendingContexts+10; i++ {
+		p.put(fmt.Sprint(i), &ServerContext{})
+	}
+	if len(p.contexts) != maxPendingContexts {
+		t.Fatalf("expected %d pending contexts, got %d", maxPendingContexts, len(p.contexts))
+	}
+	if p.take("0") != nil || p.take(fmt.Sprint(maxPendingContexts+9)) == nil {
+		t.Fatalf("expected the oldest contexts to be dropped")
+	}
+
+	// handshakes restarted on a connection leave a single context
+	for i := 0; i < 3*maxPendingContexts; i++ {
+		p.put("again", &ServerContext{})
+	}
+	if len(p.order) > 2*maxPendingContexts+1 || p.take("again") == nil {
+		t.Fatalf("expected the pending contexts to be compacted, got %d", len(p.order))
+	}
+
+	p.contexts["old"] = pendingContext{&ServerContext{}, time.Now().Add(-2 * pendingContextTimeout)}
+	if p.take("old") != nil {
+		t.Fatalf("expected expired context to be dropped")
+	}
+}
+
+func TestServerContextClockSkew(t *testing.T) {
+	for _, table := range []struct {
+		age, maxClockSkew time.Duration
+		err               error
+	}{
+		{time.Minute, 0, nil},
+		{-time.Hour, 0, nil},
+		{37 * time.Hour, 0, ErrClockSkew},
+		{-37 * time.Hour, 0, ErrClockSkew},
+		{10 * time.Minute, 5 * time.Minute, ErrClockSkew},
+		{72 * time.Hour, 96 * time.Hour, nil},
+	} {
+		s := newTestServer()
+		s.MaxClockSkew = table.maxClockSkew
+		c := s.NewContext()
+		nm, err := NewNegotiateMessage("", "")
+		if err != nil {
+			t.Fatalf("error creating negotiate message: %s", err)
+		}
+		challenge, err := c.ProcessNegotiate(nm)
+		if err != nil {
+			t.Fatalf("error processing negotiate message: %s", err)
+		}
+
+		// the client echoes the timestamp of the server, replay an older one
+		var cm challengeMessage
+		if err := cm.UnmarshalBinary(challenge); err != nil {
+			t.Fatalf("error parsing challenge message: %s", err)
+		}
+		cm.TargetInfoPairs.SetTimestamp(time.Now().Add(-table.age))
+		cm.TargetInfo = marshalAVPairs(cm.TargetInfoPairs)
+		challenge, err = cm.ChallengeMessage.MarshalBinary()
+		if err != nil {
+			t.Fatalf("error creating challenge message: %s", err)
+		}
+
+		am, err := ProcessChallenge(challenge, username, password, true)
+		if err != nil {
+			t.Fatalf("error processing challenge: %s", err)
+		}
+		if _, err := c.ProcessAuthenticate(am); !errors.Is(err, table.err) {
+			t.Fatalf("expected %v for a timestamp %s old, got %v", table.err, table.age, err)
+		}
+	}
+}
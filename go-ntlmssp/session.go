@@ -0,0 +1,190 @@
+package ntlmssp
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rc4"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+const signatureVersion = 1
+
+var (
+	clientSigningMagic = []byte("session key to client-to-server signing key magic constant\x00")
+	serverSigningMagic = []byte("session key to server-to-client signing key magic constant\x00")
+	clientSealingMagic = []byte("session key to client-to-server sealing key magic constant\x00")
+	serverSealingMagic = []byte("session key to server-to-client sealing key magic constant\x00")
+)
+
+// Session provides message integrity and confidentiality for an established
+// NTLM security context, using NTLM2 extended session security, see
+// https://msdn.microsoft.com/en-us/library/cc236702.aspx .
+// A Session is safe for concurrent use, but messages must be signed or sealed
+// in the order in which the peer verifies or unseals them.
+type Session struct {
+	flags NegotiateFlags
+
+	mu sync.Mutex
+
+	outSigningKey []byte
+	outHandle     *rc4.Cipher
+	outSeqNum     uint32
+
+	inSigningKey []byte
+	inHandle     *rc4.Cipher
+	inSeqNum     uint32
+}
+
+// NewClientSession creates the client side of a Session from the AUTHENTICATE message
+// sent to the server and the exported session key returned by ProcessChallengeWithOptions
+// or ProcessChallengeWithHashAndOptions.
+func NewClientSession(authenticateMessage, exportedSessionKey []byte) (*Session, error) {
+	var f authenticateMessageFields
+	if err := binary.Read(bytes.NewReader(authenticateMessage), binary.LittleEndian, &f); err != nil {
+		logger().Debug("error reading authenticate message fields", "error", err)
+		return nil, err
+	}
+	if !f.messageHeader.IsValid() || f.MessageType != 3 {
+		logger().Debug("message is not a valid authenticate message")
+		return nil, fmt.Errorf("%w: not an authenticate message", ErrInvalidMessage)
+	}
+	return newSession(f.NegotiateFlags, exportedSessionKey, true)
+}
+
+func newSession(flags NegotiateFlags, exportedSessionKey []byte, client bool) (*Session, error) {
+	if !flags.Has(negotiateFlagNTLMSSPNEGOTIATEEXTENDEDSESSIONSECURITY) {
+		logger().Debug("only extended session security is supported for signing and sealing")
+		return nil, fmt.Errorf("%w: extended session security is required for signing and sealing (NTLMSSP_NEGOTIATE_EXTENDED_SESSIONSECURITY)", ErrNotNegotiated)
+	}
+	if len(exportedSessionKey) != 16 {
+		logger().Debug("invalid exported session key length", "length", len(exportedSessionKey))
+		return nil, errors.New("exported session key must be 16 bytes")
+	}
+
+	sealKey := exportedSessionKey
+	switch {
+	case flags.Has(negotiateFlagNTLMSSPNEGOTIATE128):
+	case flags.Has(negotiateFlagNTLMSSPNEGOTIATE56):
+		sealKey = sealKey[:7]
+	default:
+		sealKey = sealKey[:5]
+	}
+
+	clientSigningKey := md5Sum(exportedSessionKey, clientSigningMagic)
+	serverSigningKey := md5Sum(exportedSessionKey, serverSigningMagic)
+	clientHandle, err := rc4.NewCipher(md5Sum(sealKey, clientSealingMagic))
+	if err != nil {
+		return nil, err
+	}
+	serverHandle, err := rc4.NewCipher(md5Sum(sealKey, serverSealingMagic))
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Session{flags: flags}
+	if client {
+		s.outSigningKey, s.outHandle = clientSigningKey, clientHandle
+		s.inSigningKey, s.inHandle = serverSigningKey, serverHandle
+	} else {
+		s.outSigningKey, s.outHandle = serverSigningKey, serverHandle
+		s.inSigningKey, s.inHandle = clientSigningKey, clientHandle
+	}
+	return s, nil
+}
+
+// Sign returns the 16-byte NTLMSSP_MESSAGE_SIGNATURE for an outgoing message.
+func (s *Session) Sign(message []byte) ([]byte, error) {
+	if !s.flags.Has(negotiateFlagNTLMSSPNEGOTIATESIGN) {
+		logger().Debug("signing was not negotiated")
+		return nil, fmt.Errorf("%w: signing (NTLMSSP_NEGOTIATE_SIGN)", ErrNotNegotiated)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	signature := s.mac(s.outHandle, s.outSigningKey, s.outSeqNum, message)
+	s.outSeqNum++
+	return signature, nil
+}
+
+// Verify checks the signature of an incoming message.
+func (s *Session) Verify(message, signature []byte) error {
+	if !s.flags.Has(negotiateFlagNTLMSSPNEGOTIATESIGN) {
+		logger().Debug("signing was not negotiated")
+		return fmt.Errorf("%w: signing (NTLMSSP_NEGOTIATE_SIGN)", ErrNotNegotiated)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expected := s.mac(s.inHandle, s.inSigningKey, s.inSeqNum, message)
+	s.inSeqNum++
+	if !hmac.Equal(expected, signature) {
+		logger().Debug("message signature mismatch")
+		return ErrSignatureMismatch
+	}
+	return nil
+}
+
+// Seal encrypts an outgoing message and returns it together with its signature.
+func (s *Session) Seal(message []byte) ([]byte, []byte, error) {
+	if !s.flags.Has(negotiateFlagNTLMSSPNEGOTIATESEAL) {
+		logger().Debug("sealing was not negotiated")
+		return nil, nil, fmt.Errorf("%w: sealing (NTLMSSP_NEGOTIATE_SEAL)", ErrNotNegotiated)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sealed := make([]byte, len(message))
+	s.outHandle.XORKeyStream(sealed, message)
+	signature := s.mac(s.outHandle, s.outSigningKey, s.outSeqNum, message)
+	s.outSeqNum++
+	return sealed, signature, nil
+}
+
+// Unseal decrypts an incoming message and checks its signature.
+func (s *Session) Unseal(sealed, signature []byte) ([]byte, error) {
+	if !s.flags.Has(negotiateFlagNTLMSSPNEGOTIATESEAL) {
+		logger().Debug("sealing was not negotiated")
+		return nil, fmt.Errorf("%w: sealing (NTLMSSP_NEGOTIATE_SEAL)", ErrNotNegotiated)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	message := make([]byte, len(sealed))
+	s.inHandle.XORKeyStream(message, sealed)
+	expected := s.mac(s.inHandle, s.inSigningKey, s.inSeqNum, message)
+	s.inSeqNum++
+	if !hmac.Equal(expected, signature) {
+		logger().Debug("message signature mismatch")
+		return nil, ErrSignatureMismatch
+	}
+	return message, nil
+}
+
+// mac computes the NTLMSSP_MESSAGE_SIGNATURE with extended session security
+func (s *Session) mac(handle *rc4.Cipher, signingKey []byte, seqNum uint32, message []byte) []byte {
+	seq := make([]byte, 4)
+	binary.LittleEndian.PutUint32(seq, seqNum)
+
+	checksum := hmacMd5(signingKey, seq, message)[:8]
+	if s.flags.Has(negotiateFlagNTLMSSPNEGOTIATEKEYEXCH) {
+		handle.XORKeyStream(checksum, checksum)
+	}
+
+	signature := make([]byte, 16)
+	binary.LittleEndian.PutUint32(signature, signatureVersion)
+	copy(signature[4:], checksum)
+	copy(signature[12:], seq)
+	return signature
+}
+
+func md5Sum(data ...[]byte) []byte {
+	h := md5.New()
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(nil)
+}
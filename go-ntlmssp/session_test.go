@@ -0,0 +1,75 @@
+package ntlmssp
+
+import (
+	"bytes"
+	"testing"
+)
+
+// test case from MS-NLMP 4.2.4.4, https://msdn.microsoft.com/en-us/library/cc236722.aspx
+
+func TestSessionSealNTLMv2(t *testing.T) {
+	flags := NegotiateFlags(0xe28a8233)
+	exportedSessionKey := bytes.Repeat([]byte{0x55}, 16)
+	plaintext := toUnicode("Plaintext")
+
+	client, err := newSession(flags, exportedSessionKey, true)
+	if err != nil {
+		t.Fatalf("error creating client session: %s", err)
+	}
+
+	sealed, signature, err := client.Seal(plaintext)
+	if err != nil {
+		t.Fatalf("error sealing message: %s", err)
+	}
+	if expected := []byte{
+		0x54, 0xe5, 0x01, 0x65, 0xbf, 0x19, 0x36, 0xdc, 0x99, 0x60, 0x20, 0xc1, 0x81, 0x1b, 0x0f, 0x06, 0xfb, 0x5f,
+	}; !bytes.Equal(sealed, expected) {
+		t.Fatalf("expected sealed data %x, got %x", expected, sealed)
+	}
+	if expected := []byte{
+		0x01, 0x00, 0x00, 0x00, 0x7f, 0xb3, 0x8e, 0xc5, 0xc5, 0x5d, 0x49, 0x76, 0x00, 0x00, 0x00, 0x00,
+	}; !bytes.Equal(signature, expected) {
+		t.Fatalf("expected signature %x, got %x", expected, signature)
+	}
+}
+
+func TestSessionRoundTrip(t *testing.T) {
+	flags := defaultFlags | negotiateFlagNTLMSSPNEGOTIATESIGN | negotiateFlagNTLMSSPNEGOTIATESEAL | negotiateFlagNTLMSSPNEGOTIATEKEYEXCH
+	exportedSessionKey := bytes.Repeat([]byte{0x55}, 16)
+
+	client, err := newSession(flags, exportedSessionKey, true)
+	if err != nil {
+		t.Fatalf("error creating client session: %s", err)
+	}
+	server, err := newSession(flags, exportedSessionKey, false)
+	if err != nil {
+		t.Fatalf("error creating server session: %s", err)
+	}
+
+	for _, message := range [][]byte{[]byte("first"), []byte("second"), {}} {
+		sealed, signature, err := client.Seal(message)
+		if err != nil {
+			t.Fatalf("error sealing message: %s", err)
+		}
+		unsealed, err := server.Unseal(sealed, signature)
+		if err != nil {
+			t.Fatalf("error unsealing message: %s", err)
+		}
+		if !bytes.Equal(unsealed, message) {
+			t.Fatalf("expected %x, got %x", message, unsealed)
+		}
+
+		signature, err = server.Sign(message)
+		if err != nil {
+			t.Fatalf("error signing message: %s", err)
+		}
+		if err := client.Verify(message, signature); err != nil {
+			t.Fatalf("error verifying message: %s", err)
+		}
+	}
+
+	signature, _ := client.Sign([]byte("message"))
+	if err := server.Verify([]byte("tampered"), signature); err == nil {
+		t.Fatalf("expected verification of a tampered message to fail")
+	}
+}
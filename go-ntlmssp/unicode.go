@@ -3,8 +3,7 @@ package ntlmssp
 import (
 	"bytes"
 	"encoding/binary"
-	"errors"
-	"log"
+	"fmt"
 	"unicode/utf16"
 )
 
@@ -12,13 +11,13 @@ import (
 
 func fromUnicode(d []byte) (string, error) {
 	if len(d)%2 > 0 {
-		log.Printf("[DEBUG]%s unicode (utf16le) specified, but uneven data length", CallerInfo())
-		return "", errors.New("unicode (utf 16 le) specified, but uneven data length")
+		logger().Debug("unicode (utf16le) specified, but uneven data length")
+		return "", fmt.Errorf("%w: unicode (utf 16 le) specified, but uneven data length", ErrInvalidMessage)
 	}
 	s := make([]uint16, len(d)/2)
 	err := binary.Read(bytes.NewReader(d), binary.LittleEndian, &s)
 	if err != nil {
-		log.Printf("[DEBUG]%s error reading bytes: %s", CallerInfo(), err.Error())
+		logger().Debug("error reading bytes", "error", err)
 		return "", err
 	}
 	return string(utf16.Decode(s)), nil
@@ -1,8 +1,7 @@
 package ntlmssp
 
 import (
-	"errors"
-	"log"
+	"fmt"
 )
 
 type varField struct {
@@ -12,24 +11,30 @@ type varField struct {
 }
 
 func (f varField) ReadFrom(buffer []byte) ([]byte, error) {
-	if len(buffer) < int(f.BufferOffset+uint32(f.Len)) {
-		log.Printf("[DEBUG]%s error reading data, varfield extends beyond buffer", CallerInfo())
-		return nil, errors.New("error reading data, varField extends beyond buffer")
+	if f.Len == 0 {
+		return nil, nil
 	}
-	return buffer[f.BufferOffset : f.BufferOffset+uint32(f.Len)], nil
+	// in 64 bits, the offset and length of a hostile message may overflow 32 bits
+	end := uint64(f.BufferOffset) + uint64(f.Len)
+	if uint64(len(buffer)) < end {
+		logger().Debug("error reading data, varfield extends beyond buffer")
+		return nil, fmt.Errorf("%w: varField extends beyond buffer", ErrInvalidMessage)
+	}
+	return buffer[f.BufferOffset:end], nil
 }
 
-func (f varField) ReadStringFrom(buffer []byte, unicode bool) (string, error) {
+// ReadStringFrom reads a UTF-16LE string if unicode is set, or a string
+// encoded with the OEM code page cp otherwise.
+func (f varField) ReadStringFrom(buffer []byte, unicode bool, cp *CodePage) (string, error) {
 	d, err := f.ReadFrom(buffer)
 	if err != nil {
-		log.Printf("[DEBUG]%s error reading from buffer: %s", CallerInfo(), err.Error())
+		logger().Debug("error reading from buffer", "error", err)
 		return "", err
 	}
 	if unicode { // UTF-16LE encoding scheme
 		return fromUnicode(d)
 	}
-	// OEM encoding, close enough to ASCII, since no code page is specified
-	return string(d), err
+	return cp.decodeString(d), nil
 }
 
 func newVarField(ptr *int, fieldsize int) varField {
@@ -41,3 +46,15 @@ func newVarField(ptr *int, fieldsize int) varField {
 	*ptr += fieldsize
 	return f
 }
+
+// payloadOffset returns where the payload of a message starts, that is the smallest
+// offset of the non-empty fields, or the length of the message if all are empty.
+func payloadOffset(buffer []byte, fields ...varField) uint32 {
+	offset := uint32(len(buffer))
+	for _, f := range fields {
+		if f.Len > 0 && f.BufferOffset < offset {
+			offset = f.BufferOffset
+		}
+	}
+	return offset
+}
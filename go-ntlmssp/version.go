@@ -1,5 +1,10 @@
 package ntlmssp
 
+import (
+	"encoding/binary"
+	"io"
+)
+
 // Version is a struct representing https://msdn.microsoft.com/en-us/library/cc236654.aspx
 type Version struct {
 	ProductMajorVersion uint8
@@ -18,3 +23,16 @@ func DefaultVersion() Version {
 		NTLMRevisionCurrent: 15,
 	}
 }
+
+// readVersion reads a Version, returning nil if it is all zeros
+func readVersion(r io.Reader) (*Version, error) {
+	var v Version
+	if err := binary.Read(r, binary.LittleEndian, &v); err != nil {
+		logger().Debug("error reading version", "error", err)
+		return nil, err
+	}
+	if v == (Version{}) {
+		return nil, nil
+	}
+	return &v, nil
+}